@@ -0,0 +1,65 @@
+package easiest
+
+import (
+	"errors"
+	"net"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// access is the allow and deny lists of IPs, a nil access allows all.
+type access struct {
+	allow ipNets
+	deny  ipNets
+}
+
+func newAccess(conf AccessConfig) (*access, error) {
+	if len(conf.Allow) == 0 && len(conf.Deny) == 0 {
+		return nil, nil
+	}
+	allow, err := parseIPNets(conf.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseIPNets(conf.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &access{
+		allow: allow,
+		deny:  deny,
+	}, nil
+}
+
+// allowed reports whether the ip is allowed, the deny list takes precedence.
+func (a *access) allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if a.deny.Contains(ip) {
+		return false
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	return a.allow.Contains(ip)
+}
+
+// allowedConn reports whether the conn is allowed by the global and the route access,
+// a nil route checks only the global.
+// The conn from a trusted proxy is left to the check of each request unless it's a stream.
+func (s *Server) allowedConn(route *routeEntry, conn net.Conn) bool {
+	ip := addrIP(conn.RemoteAddr())
+	if s.trustedProxies.Contains(ip) && (route == nil || !route.Stream) {
+		return true
+	}
+	return s.allowedIP(route, ip)
+}
+
+// allowedIP reports whether the ip is allowed by the global and the route access.
+func (s *Server) allowedIP(route *routeEntry, ip net.IP) bool {
+	if !s.access.allowed(ip) {
+		return false
+	}
+	return route == nil || route.access.allowed(ip)
+}
@@ -0,0 +1,188 @@
+package easiest
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_newAccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    AccessConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			wantNil: true,
+		},
+		{
+			name: "ip and cidr",
+			conf: AccessConfig{Allow: []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"}},
+		},
+		{
+			name:    "invalid ip",
+			conf:    AccessConfig{Deny: []string{"10.0.0.256"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cidr",
+			conf:    AccessConfig{Allow: []string{"10.0.0.0/33"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newAccess(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAccess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got == nil) != tt.wantNil {
+				t.Errorf("newAccess() = %v, wantNil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func Test_access_allowed(t *testing.T) {
+	tests := []struct {
+		name string
+		conf AccessConfig
+		ip   string
+		want bool
+	}{
+		{
+			name: "allowed",
+			conf: AccessConfig{Allow: []string{"10.0.0.0/8"}},
+			ip:   "10.1.2.3",
+			want: true,
+		},
+		{
+			name: "not in allow",
+			conf: AccessConfig{Allow: []string{"10.0.0.0/8"}},
+			ip:   "192.168.0.1",
+			want: false,
+		},
+		{
+			name: "deny only",
+			conf: AccessConfig{Deny: []string{"192.168.0.1"}},
+			ip:   "192.168.0.2",
+			want: true,
+		},
+		{
+			name: "deny over allow",
+			conf: AccessConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}},
+			ip:   "10.0.0.1",
+			want: false,
+		},
+		{
+			name: "ipv6",
+			conf: AccessConfig{Allow: []string{"2001:db8::/32"}},
+			ip:   "2001:db8::1",
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAccess(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Server_allowedConn(t *testing.T) {
+	global, err := newAccess(AccessConfig{Deny: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeAccess, err := newAccess(AccessConfig{Allow: []string{"10.0.0.0/24", "192.168.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies, err := parseIPNets([]string{"192.168.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		access:         global,
+		trustedProxies: trustedProxies,
+	}
+	denyProxy, err := newAccess(AccessConfig{Deny: []string{"192.168.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpRoute := &routeEntry{access: routeAccess}
+	streamRoute := &routeEntry{Route: Route{Stream: true}, access: routeAccess}
+	tests := []struct {
+		name  string
+		route *routeEntry
+		ip    string
+		want  bool
+	}{
+		{
+			name: "global only",
+			ip:   "10.0.1.1",
+			want: true,
+		},
+		{
+			name: "global deny",
+			ip:   "10.0.0.1",
+			want: false,
+		},
+		{
+			name:  "global deny with route allow",
+			route: httpRoute,
+			ip:    "10.0.0.1",
+			want:  false,
+		},
+		{
+			name:  "route allow",
+			route: httpRoute,
+			ip:    "10.0.0.2",
+			want:  true,
+		},
+		{
+			name:  "not in route allow",
+			route: httpRoute,
+			ip:    "10.0.1.1",
+			want:  false,
+		},
+		{
+			name:  "trusted proxy left to the requests",
+			route: &routeEntry{access: denyProxy},
+			ip:    "192.168.0.1",
+			want:  true,
+		},
+		{
+			name:  "trusted proxy checked on streams",
+			route: &routeEntry{Route: Route{Stream: true}, access: denyProxy},
+			ip:    "192.168.0.1",
+			want:  false,
+		},
+		{
+			name:  "stream not in route allow",
+			route: streamRoute,
+			ip:    "10.0.1.1",
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			conn := &addrConn{
+				Conn:       c1,
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1234},
+			}
+			if got := s.allowedConn(tt.route, conn); got != tt.want {
+				t.Errorf("allowedConn() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package easiest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLog writes an entry for each HTTP request and stream connection.
+type accessLog struct {
+	format string
+	mut    sync.Mutex
+	w      io.Writer
+}
+
+// accessLogEntry is an HTTP request if Method is set, or else a stream connection.
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Route    string    `json:"route"`
+	ClientIP string    `json:"clientIP"`
+	Upstream string    `json:"upstream,omitempty"`
+	Duration float64   `json:"durationSeconds"`
+
+	Method    string `json:"method,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Bytes     int64  `json:"bytes,omitempty"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+
+	BytesIn     int64  `json:"bytesIn,omitempty"`
+	BytesOut    int64  `json:"bytesOut,omitempty"`
+	CloseReason string `json:"closeReason,omitempty"`
+}
+
+func newAccessLog(conf AccessLogConfig) (*accessLog, error) {
+	switch conf.Format {
+	case "":
+		conf.Format = "combined"
+	case "common", "combined", "extended", "json":
+	default:
+		return nil, fmt.Errorf("unsupported format %q", conf.Format)
+	}
+	var w io.Writer = os.Stdout
+	if conf.Path != "" && conf.Path != "-" {
+		if conf.MaxSize == 0 {
+			conf.MaxSize = 100 * 1024 * 1024
+		}
+		maxBackups := 5
+		if conf.MaxBackups != nil {
+			maxBackups = *conf.MaxBackups
+		}
+		f, err := openRotatingFile(conf.Path, conf.MaxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &accessLog{
+		format: conf.Format,
+		w:      w,
+	}, nil
+}
+
+// newRequestLogEntry returns the entry of the request before it's rewritten for the upstream,
+// the response is filled in once handled.
+func (s *Server) newRequestLogEntry(ctx *fasthttp.RequestCtx, route *routeEntry) *accessLogEntry {
+	req := &ctx.Request
+	entry := &accessLogEntry{
+		Time:      ctx.Time(),
+		ClientIP:  formatIP(s.clientIP(ctx)),
+		Method:    string(req.Header.Method()),
+		Host:      string(req.Host()),
+		Path:      string(req.RequestURI()),
+		Proto:     string(req.Header.Protocol()),
+		Referer:   string(req.Header.Referer()),
+		UserAgent: string(req.Header.UserAgent()),
+	}
+	if route != nil {
+		entry.Upstream = route.Target
+	}
+	return entry
+}
+
+// newStreamLogEntry returns the entry of the stream connection before the upstream is dialed,
+// the bytes and the close reason are filled in once closed.
+func (s *Server) newStreamLogEntry(route *routeEntry, downstream net.Conn) *accessLogEntry {
+	return &accessLogEntry{
+		Time:     time.Now(),
+		Route:    route.name(),
+		ClientIP: formatIP(addrIP(downstream.RemoteAddr())),
+		Upstream: route.Target,
+	}
+}
+
+func (s *Server) writeAccessLog(entry *accessLogEntry) {
+	err := s.accessLog.log(entry)
+	if err != nil {
+		if s.logger != nil {
+			s.logger.Println("accessLog", err)
+		}
+	}
+}
+
+// closeReasonDialError is the close reason of a stream connection whose upstream can't be dialed.
+const closeReasonDialError = "dial_error"
+
+// closeReason returns why the stream connection was closed.
+func closeReason(ctx context.Context, err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil && ctx.Err() != nil:
+		return "shutdown"
+	case err == nil:
+		return "closed"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
+
+func formatIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func (l *accessLog) log(entry *accessLogEntry) error {
+	line := l.formatEntry(entry)
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+func (l *accessLog) formatEntry(entry *accessLogEntry) []byte {
+	if l.format == "json" {
+		data, _ := json.Marshal(entry)
+		return append(data, '\n')
+	}
+
+	// The Common Log Format has no fields for the streams,
+	// the request line is the route and the bytes are the ones sent to the client.
+	// The extended format is the combined one followed by the host, the upstream and the duration,
+	// so the common and combined lines are kept to the spec of their parsers.
+	var buf bytes.Buffer
+	request := "STREAM " + entry.Route
+	status := "-"
+	size := entry.BytesOut
+	if entry.Method != "" {
+		request = entry.Method + " " + entry.Path + " " + entry.Proto
+		status = strconv.Itoa(entry.Status)
+		size = entry.Bytes
+	}
+	fmt.Fprintf(&buf, "%s - - [%s] %s %s %s",
+		clfField(entry.ClientIP),
+		entry.Time.Format(clfTimeFormat),
+		strconv.Quote(request),
+		status,
+		clfSize(size),
+	)
+	if l.format == "combined" || l.format == "extended" {
+		fmt.Fprintf(&buf, " %s %s", strconv.Quote(clfField(entry.Referer)), strconv.Quote(clfField(entry.UserAgent)))
+	}
+	if l.format == "extended" {
+		fmt.Fprintf(&buf, " %s %s %dms",
+			strconv.Quote(clfField(entry.Host)),
+			strconv.Quote(clfField(entry.Upstream)),
+			int64(entry.Duration*1000),
+		)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func clfSize(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// rotatingFile is a file renamed with a number suffix when it reaches the max size,
+// only the latest max backups are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mut        sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes to the file, the error of a failed rotation is returned after the write,
+// so the entries are kept in the current file.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	var rotateErr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+// rotate moves the file to the backups and opens a new one,
+// the path is opened again on failure.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err == nil {
+		if f.maxBackups > 0 {
+			for i := f.maxBackups - 1; i > 0; i-- {
+				os.Rename(f.backup(i), f.backup(i+1))
+			}
+			err = os.Rename(f.path, f.backup(1))
+		} else {
+			err = os.Remove(f.path)
+		}
+	}
+	openErr := f.open()
+	if err != nil {
+		return err
+	}
+	return openErr
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
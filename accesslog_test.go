@@ -0,0 +1,259 @@
+package easiest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_accessLog_formatEntry(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	request := &accessLogEntry{
+		Time:      now,
+		Route:     "example.com",
+		ClientIP:  "10.0.0.1",
+		Upstream:  "http://127.0.0.1:8080",
+		Duration:  0.5,
+		Method:    "GET",
+		Host:      "example.com",
+		Path:      "/a?b=c",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Bytes:     5,
+		UserAgent: "curl/7.0",
+	}
+	stream := &accessLogEntry{
+		Time:        now,
+		Route:       ":2222",
+		ClientIP:    "10.0.0.1",
+		Upstream:    "tcp://127.0.0.1:22",
+		Duration:    2,
+		BytesIn:     10,
+		BytesOut:    20,
+		CloseReason: "closed",
+	}
+	tests := []struct {
+		format string
+		entry  *accessLogEntry
+		want   string
+	}{
+		{
+			format: "common",
+			entry:  request,
+			want:   `10.0.0.1 - - [02/Jan/2022:03:04:05 +0000] "GET /a?b=c HTTP/1.1" 200 5` + "\n",
+		},
+		{
+			format: "combined",
+			entry:  request,
+			want:   `10.0.0.1 - - [02/Jan/2022:03:04:05 +0000] "GET /a?b=c HTTP/1.1" 200 5 "-" "curl/7.0"` + "\n",
+		},
+		{
+			format: "extended",
+			entry:  request,
+			want:   `10.0.0.1 - - [02/Jan/2022:03:04:05 +0000] "GET /a?b=c HTTP/1.1" 200 5 "-" "curl/7.0" "example.com" "http://127.0.0.1:8080" 500ms` + "\n",
+		},
+		{
+			format: "common",
+			entry:  stream,
+			want:   `10.0.0.1 - - [02/Jan/2022:03:04:05 +0000] "STREAM :2222" - 20` + "\n",
+		},
+		{
+			format: "extended",
+			entry:  stream,
+			want:   `10.0.0.1 - - [02/Jan/2022:03:04:05 +0000] "STREAM :2222" - 20 "-" "-" "-" "tcp://127.0.0.1:22" 2000ms` + "\n",
+		},
+		{
+			format: "json",
+			entry:  request,
+			want:   `{"time":"2022-01-02T03:04:05Z","route":"example.com","clientIP":"10.0.0.1","upstream":"http://127.0.0.1:8080","durationSeconds":0.5,"method":"GET","host":"example.com","path":"/a?b=c","proto":"HTTP/1.1","status":200,"bytes":5,"userAgent":"curl/7.0"}` + "\n",
+		},
+		{
+			format: "json",
+			entry:  stream,
+			want:   `{"time":"2022-01-02T03:04:05Z","route":":2222","clientIP":"10.0.0.1","upstream":"tcp://127.0.0.1:22","durationSeconds":2,"bytesIn":10,"bytesOut":20,"closeReason":"closed"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			l := &accessLog{format: tt.format}
+			if got := string(l.formatEntry(tt.entry)); got != tt.want {
+				t.Errorf("formatEntry() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_rotatingFile_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1111111\n", "2222222\n", "3333333\n", "4444444\n"} {
+		_, err := f.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "4444444\n",
+		path + ".1": "3333333\n",
+		path + ".2": "2222222\n",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond the max is kept")
+	}
+}
+
+func Test_rotatingFile_Write_noBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1111111\n", "2222222\n"} {
+		_, err := f.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "2222222\n" {
+		t.Errorf("%s = %q, want %q", path, got, "2222222\n")
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("backup is kept")
+	}
+}
+
+func Test_rotatingFile_Write_rotateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// The backup can't be renamed over a directory that is not empty
+	err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("1111111\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("2222222\n"))
+	if err == nil {
+		t.Fatal("rotation error is not returned")
+	}
+
+	// The writes go on to the file once the backup can be renamed
+	err = os.RemoveAll(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte("3333333\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		path:        "3333333\n",
+		path + ".1": "1111111\n2222222\n",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func Test_newAccessLog_maxBackups(t *testing.T) {
+	zero := 0
+	l, err := newAccessLog(AccessLogConfig{
+		Path:       filepath.Join(t.TempDir(), "access.log"),
+		MaxBackups: &zero,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.w.(*rotatingFile).maxBackups; got != 0 {
+		t.Errorf("maxBackups = %d, want 0", got)
+	}
+}
+
+func Test_Server_bind_streamDialError(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "tcp://" + closed.Addr().String()
+	closed.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	s, err := NewServer(Config{
+		Routes: []Route{
+			{
+				Listen: "127.0.0.1:0",
+				Target: target,
+			},
+		},
+		AccessLog: &AccessLogConfig{
+			Path:   path,
+			Format: "json",
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.startListen(ctx, s.listenRoutes[0], listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The connection is closed once the entry is written
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.ReadAll(conn)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry accessLogEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		t.Fatalf("access log %q: %v", data, err)
+	}
+	if entry.CloseReason != closeReasonDialError {
+		t.Errorf("closeReason = %q, want %q", entry.CloseReason, closeReasonDialError)
+	}
+	if entry.Route != "127.0.0.1:0" || entry.Upstream != target || entry.ClientIP != "127.0.0.1" {
+		t.Errorf("entry = %+v", entry)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func newAcme(domains []string, dir string) *tls.Config {
+func newAcme(domains []string, dir string, events *intVec) *tls.Config {
 	m := &autocert.Manager{
 		Prompt: autocert.AcceptTOS,
 	}
@@ -19,7 +19,11 @@ func newAcme(domains []string, dir string) *tls.Config {
 	if dir == "" {
 		dir = cacheDir()
 	}
-	m.Cache = autocert.DirCache(dir)
+	m.Cache = &acmeMetricsCache{
+		Cache:  autocert.DirCache(dir),
+		events: events,
+		missed: map[string]bool{},
+	}
 	tlsConfig := m.TLSConfig()
 	tlsConfig.NextProtos = removeOneFromSet(tlsConfig.NextProtos, "h2")
 	return tlsConfig
@@ -0,0 +1,124 @@
+package easiest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"sync"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	basicPrefix  = []byte("Basic ")
+	bearerPrefix = []byte("Bearer ")
+)
+
+// auth checks the credentials of the requests.
+type auth struct {
+	conf AuthConfig
+	// verified is the digests of the credentials matched the bcrypt hashes,
+	// bcrypt is too slow to be checked for every request.
+	verified sync.Map
+	// dummyHash is compared for the unknown users,
+	// so they take as long as the wrong passwords and the users are not revealed.
+	dummyHash []byte
+}
+
+func newAuth(conf AuthConfig) *auth {
+	if conf.Realm == "" {
+		conf.Realm = "easiest"
+	}
+	a := &auth{
+		conf: conf,
+	}
+	if len(conf.Users) != 0 {
+		cost := bcrypt.DefaultCost
+		for _, hash := range conf.Users {
+			if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+				cost = c
+				break
+			}
+		}
+		a.dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+	}
+	return a
+}
+
+// exempt reports whether the path is under one of the exempt paths,
+// they're matched by whole segments so "/health" doesn't exempt "/healthz".
+func (a *auth) exempt(path []byte) bool {
+	for _, prefix := range a.conf.ExemptPaths {
+		if !bytes.HasPrefix(path, []byte(prefix)) {
+			continue
+		}
+		if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+// check reports whether the request carries valid credentials.
+func (a *auth) check(req *fasthttp.Request) bool {
+	authorization := req.Header.Peek(fasthttp.HeaderAuthorization)
+	switch {
+	case bytes.HasPrefix(authorization, basicPrefix):
+		return a.checkBasic(authorization[len(basicPrefix):])
+	case bytes.HasPrefix(authorization, bearerPrefix):
+		return a.checkBearer(authorization[len(bearerPrefix):])
+	}
+	return false
+}
+
+func (a *auth) checkBasic(encoded []byte) bool {
+	if len(a.conf.Users) == 0 {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	hash, ok := a.conf.Users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+
+	digest := sha256.Sum256(decoded)
+	if _, ok := a.verified.Load(digest); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	a.verified.Store(digest, struct{}{})
+	return true
+}
+
+func (a *auth) checkBearer(token []byte) bool {
+	for _, t := range a.conf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge responds the request is unauthorized.
+func (a *auth) challenge(resp *fasthttp.Response) {
+	resp.SetStatusCode(fasthttp.StatusUnauthorized)
+	if len(a.conf.Users) != 0 {
+		resp.Header.Add(fasthttp.HeaderWWWAuthenticate, `Basic realm="`+a.conf.Realm+`"`)
+	}
+	if len(a.conf.Tokens) != 0 {
+		resp.Header.Add(fasthttp.HeaderWWWAuthenticate, `Bearer realm="`+a.conf.Realm+`"`)
+	}
+}
@@ -0,0 +1,115 @@
+package easiest
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_auth_check(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAuth(AuthConfig{
+		Users: map[string]string{
+			"user": string(hash),
+		},
+		Tokens: []string{"token"},
+	})
+	tests := []struct {
+		name          string
+		authorization string
+		want          bool
+	}{
+		{
+			name:          "basic",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")),
+			want:          true,
+		},
+		{
+			name:          "basic wrong password",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")),
+			want:          false,
+		},
+		{
+			name:          "basic unknown user",
+			authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("other:secret")),
+			want:          false,
+		},
+		{
+			name:          "bearer",
+			authorization: "Bearer token",
+			want:          true,
+		},
+		{
+			name:          "bearer wrong token",
+			authorization: "Bearer wrong",
+			want:          false,
+		},
+		{
+			name: "none",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			if tt.authorization != "" {
+				req.Header.Set(fasthttp.HeaderAuthorization, tt.authorization)
+			}
+			// Twice to go through the verified cache
+			for i := 0; i != 2; i++ {
+				if got := a.check(req); got != tt.want {
+					t.Errorf("check() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_newAuth_dummyHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAuth(AuthConfig{
+		Users: map[string]string{
+			"user": string(hash),
+		},
+	})
+	// The unknown users take as long as the known ones
+	cost, err := bcrypt.Cost(a.dummyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost = %d, want %d", cost, bcrypt.MinCost)
+	}
+}
+
+func Test_auth_exempt(t *testing.T) {
+	a := newAuth(AuthConfig{
+		ExemptPaths: []string{"/health", "/static/"},
+	})
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/health", want: true},
+		{path: "/health/live", want: true},
+		{path: "/healthz-admin", want: false},
+		{path: "/static/app.js", want: true},
+		{path: "/static", want: false},
+		{path: "/staticfiles", want: false},
+		{path: "/", want: false},
+	}
+	for _, tt := range tests {
+		if got := a.exempt([]byte(tt.path)); got != tt.want {
+			t.Errorf("exempt(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
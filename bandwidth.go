@@ -0,0 +1,157 @@
+package easiest
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// byteLimiter is a token bucket of bytes, a nil byteLimiter is unlimited.
+type byteLimiter struct {
+	rate   float64
+	burst  float64
+	mut    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(conf BandwidthConfig) *byteLimiter {
+	if conf.Rate <= 0 {
+		return nil
+	}
+	burst := conf.Burst
+	if burst <= 0 {
+		burst = conf.Rate
+	}
+	return &byteLimiter{
+		rate:   float64(conf.Rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take takes n bytes and returns how long to wait until they are paid off.
+func (l *byteLimiter) take(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle waits until n bytes are allowed by all the limiters,
+// it returns false if the wait is cut short by done.
+func throttle(ctx context.Context, done <-chan struct{}, limiters []*byteLimiter, n int) bool {
+	var wait time.Duration
+	for _, l := range limiters {
+		if w := l.take(n); w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// throttleConn returns the conn limited by the limiters in both directions,
+// the waits end when the conn is closed or the ctx is done.
+func throttleConn(ctx context.Context, conn net.Conn, limiters ...*byteLimiter) net.Conn {
+	active := limiters[:0:0]
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return conn
+	}
+	throttled := &throttledConn{
+		Conn:     conn,
+		ctx:      ctx,
+		limiters: active,
+		closed:   make(chan struct{}),
+	}
+	if tlsConn, ok := conn.(tlsConnectionStater); ok {
+		// Keep the TLS state visible to the fasthttp.RequestCtx
+		return &throttledTLSConn{
+			throttledConn: throttled,
+			tls:           tlsConn,
+		}
+	}
+	return throttled
+}
+
+type tlsConnectionStater interface {
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+type throttledTLSConn struct {
+	*throttledConn
+	tls tlsConnectionStater
+}
+
+func (c *throttledTLSConn) Handshake() error {
+	return c.tls.Handshake()
+}
+
+func (c *throttledTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+type throttledConn struct {
+	net.Conn
+	ctx       context.Context
+	limiters  []*byteLimiter
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !throttle(c.ctx, c.closed, c.limiters, n) && err == nil {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	if !throttle(c.ctx, c.closed, c.limiters, len(p)) {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
@@ -0,0 +1,78 @@
+package easiest
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_byteLimiter_take(t *testing.T) {
+	l := newByteLimiter(BandwidthConfig{
+		Rate:  1000,
+		Burst: 1000,
+	})
+	if wait := l.take(1000); wait != 0 {
+		t.Errorf("take within burst, wait = %v, want 0", wait)
+	}
+	wait := l.take(500)
+	if wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("take over burst, wait = %v, want about 500ms", wait)
+	}
+}
+
+func Test_throttledConn_Close(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+	conn := throttleConn(context.Background(), c1, newByteLimiter(BandwidthConfig{
+		Rate:  1,
+		Burst: 1,
+	}))
+
+	done := make(chan error)
+	go func() {
+		// Over the burst it waits for seconds
+		_, err := conn.Write(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("write after close, want error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the wait is not cut short by the close")
+	}
+}
+
+func Test_throttledConn_ctx(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := throttleConn(ctx, c1, newByteLimiter(BandwidthConfig{
+		Rate:  1,
+		Burst: 1,
+	}))
+
+	done := make(chan error)
+	go func() {
+		_, err := conn.Write(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("write after cancel, want error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the wait is not cut short by the ctx")
+	}
+}
@@ -0,0 +1,510 @@
+package easiest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const headerXCache = "X-Cache"
+
+var errUpstreamServerError = errors.New("upstream server error")
+
+// cache is the response cache of a route.
+type cache struct {
+	conf  CacheConfig
+	store cacheStore
+
+	// authenticated is for the routes serving the requests of identified users,
+	// only the responses explicitly shared are stored
+	authenticated bool
+
+	flight flightGroup
+
+	hits        int64
+	misses      int64
+	revalidated int64
+	stale       int64
+}
+
+// cacheEntry is the response cached without its body.
+type cacheEntry struct {
+	Key          string            `json:"key"`
+	Status       int               `json:"status"`
+	Header       [][2]string       `json:"header"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	Stored       time.Time         `json:"stored"`
+	Expires      time.Time         `json:"expires"`
+	InitialAge   time.Duration     `json:"initialAge,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"lastModified,omitempty"`
+	Size         int64             `json:"size"`
+
+	StaleWhileRevalidate time.Duration `json:"staleWhileRevalidate,omitempty"`
+	StaleIfError         time.Duration `json:"staleIfError,omitempty"`
+}
+
+// requestCacheKey returns the cache key of the request, the scheme is not part of the key.
+func requestCacheKey(req *fasthttp.Request) string {
+	return string(req.Host()) + string(req.URI().RequestURI())
+}
+
+func newCache(conf CacheConfig) (*cache, error) {
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = 64 * 1024 * 1024
+	}
+	if conf.MaxEntrySize <= 0 {
+		conf.MaxEntrySize = 8 * 1024 * 1024
+	}
+	if conf.MaxEntrySize > conf.MaxSize {
+		conf.MaxEntrySize = conf.MaxSize
+	}
+	c := &cache{
+		conf: conf,
+	}
+	switch conf.Backend {
+	case "", "memory":
+		c.store = newMemoryCache(conf.MaxSize)
+	case "disk":
+		if conf.Dir == "" {
+			return nil, fmt.Errorf("dir is required for disk")
+		}
+		store, err := newDiskCache(conf.Dir, conf.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		c.store = store
+	default:
+		return nil, fmt.Errorf("unsupported backend %q", conf.Backend)
+	}
+	return c, nil
+}
+
+// do serves the request from the cache, or fetches it and stores the response.
+// The conditional requests of the client are answered by the cache,
+// the upstream only sees the conditions of the entries to revalidate.
+func (c *cache) do(key string, req *fasthttp.Request, resp *fasthttp.Response, fetch func(req *fasthttp.Request, resp *fasthttp.Response) error) error {
+	if !req.Header.IsGet() {
+		return fetch(req, resp)
+	}
+	reqCacheControl := parseCacheControl(req.Header.Peek(fasthttp.HeaderCacheControl))
+	if _, ok := reqCacheControl["no-store"]; ok {
+		return fetch(req, resp)
+	}
+	noCache := reqCacheControl["max-age"] == "0"
+	if _, ok := reqCacheControl["no-cache"]; ok {
+		noCache = true
+	}
+	if len(reqCacheControl) == 0 && bytes.Equal(req.Header.Peek(fasthttp.HeaderPragma), []byte("no-cache")) {
+		noCache = true
+	}
+
+	ifNoneMatch := string(req.Header.Peek(fasthttp.HeaderIfNoneMatch))
+	ifModifiedSince := string(req.Header.Peek(fasthttp.HeaderIfModifiedSince))
+	req.Header.Del(fasthttp.HeaderIfNoneMatch)
+	req.Header.Del(fasthttp.HeaderIfModifiedSince)
+
+	now := time.Now()
+	entry, body, ok := c.lookup(key, req)
+	switch {
+	case ok && !noCache && entry.fresh(now):
+		atomic.AddInt64(&c.hits, 1)
+		entry.serve(resp, body, now, "HIT")
+	case ok && !noCache && now.Before(entry.Expires.Add(entry.StaleWhileRevalidate)):
+		atomic.AddInt64(&c.stale, 1)
+		entry.serve(resp, body, now, "STALE")
+		c.refresh(key, entry, body, req, fetch)
+	default:
+		err := c.miss(key, entry, body, req, resp, fetch)
+		if err != nil || resp.StatusCode() >= fasthttp.StatusInternalServerError {
+			now = time.Now()
+			if entry == nil || !now.Before(entry.Expires.Add(entry.StaleIfError)) {
+				return err
+			}
+			atomic.AddInt64(&c.stale, 1)
+			entry.serve(resp, body, now, "STALE")
+		}
+	}
+	notModified(resp, ifNoneMatch, ifModifiedSince)
+	return nil
+}
+
+// miss fetches the response, the concurrent misses of the key wait for the first one
+// and are served with what it stores.
+func (c *cache) miss(key string, entry *cacheEntry, body []byte, req *fasthttp.Request, resp *fasthttp.Response, fetch func(req *fasthttp.Request, resp *fasthttp.Response) error) error {
+	if entry != nil {
+		entry.setConditions(req)
+	}
+	call, leader := c.flight.start(key)
+	if leader {
+		err := c.fetch(key, entry, body, req, resp, fetch)
+		callErr := err
+		if err == nil && resp.StatusCode() >= fasthttp.StatusInternalServerError {
+			callErr = errUpstreamServerError
+		}
+		c.flight.finish(key, call, callErr)
+		return err
+	}
+
+	<-call.done
+	if call.err == nil {
+		shared, sharedBody, ok := c.lookup(key, req)
+		if ok && (entry == nil || shared.Stored.After(entry.Stored)) {
+			atomic.AddInt64(&c.hits, 1)
+			shared.serve(resp, sharedBody, time.Now(), "HIT")
+			return nil
+		}
+	} else if entry != nil && time.Now().Before(entry.Expires.Add(entry.StaleIfError)) {
+		// The stale entry is served for the error of the first one
+		return call.err
+	}
+	// Nothing stored by the first one
+	return c.fetch(key, entry, body, req, resp, fetch)
+}
+
+// refresh revalidates the entry in the background.
+func (c *cache) refresh(key string, entry *cacheEntry, body []byte, req *fasthttp.Request, fetch func(req *fasthttp.Request, resp *fasthttp.Response) error) {
+	call, leader := c.flight.start(key)
+	if !leader {
+		return
+	}
+	bgReq := fasthttp.AcquireRequest()
+	req.CopyTo(bgReq)
+	entry.setConditions(bgReq)
+	go func() {
+		defer fasthttp.ReleaseRequest(bgReq)
+		bgResp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(bgResp)
+		err := c.fetch(key, entry, body, bgReq, bgResp, fetch)
+		c.flight.finish(key, call, err)
+	}()
+}
+
+// fetch sends the request to the upstream and stores the response.
+func (c *cache) fetch(key string, entry *cacheEntry, body []byte, req *fasthttp.Request, resp *fasthttp.Response, fetch func(req *fasthttp.Request, resp *fasthttp.Response) error) error {
+	err := fetch(req, resp)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if entry != nil && resp.StatusCode() == fasthttp.StatusNotModified {
+		atomic.AddInt64(&c.revalidated, 1)
+		c.revalidate(key, entry, body, req, resp, now)
+		resp.Header.Set(headerXCache, "REVALIDATED")
+		return nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+	if resp.StatusCode() < fasthttp.StatusInternalServerError {
+		c.set(key, req, resp, now)
+	}
+	resp.Header.Set(headerXCache, "MISS")
+	return nil
+}
+
+// lookup returns the entry of the key matching the Vary of the request.
+func (c *cache) lookup(key string, req *fasthttp.Request) (*cacheEntry, []byte, bool) {
+	entry, body, ok := c.store.get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	for name, value := range entry.Vary {
+		if string(req.Header.Peek(name)) != value {
+			return nil, nil, false
+		}
+	}
+	return entry, body, true
+}
+
+// revalidate writes the entry updated by the headers of the 304 response.
+func (c *cache) revalidate(key string, entry *cacheEntry, body []byte, req *fasthttp.Request, resp *fasthttp.Response, now time.Time) {
+	var updates [][2]string
+	resp.Header.VisitAll(func(k, v []byte) {
+		if !cacheSkipHeader(string(k)) {
+			updates = append(updates, [2]string{string(k), string(v)})
+		}
+	})
+	entry.write(resp, body)
+	for _, update := range updates {
+		resp.Header.Set(update[0], update[1])
+	}
+	if !c.set(key, req, resp, now) {
+		c.store.delete(key)
+	}
+}
+
+// purge removes the entries of the keys matched, and returns how many are removed.
+func (c *cache) purge(match func(key string) bool) int {
+	n := 0
+	for _, entry := range c.store.entries() {
+		if match(entry.Key) && c.store.delete(entry.Key) {
+			n++
+		}
+	}
+	return n
+}
+
+// set stores the response if it's allowed.
+func (c *cache) set(key string, req *fasthttp.Request, resp *fasthttp.Response, now time.Time) bool {
+	entry, ok := c.newEntry(key, req, resp, now)
+	if !ok || entry.Size > c.conf.MaxSize {
+		return false
+	}
+	body := append([]byte(nil), resp.Body()...)
+	return c.store.set(entry, body) == nil
+}
+
+func (c *cache) newEntry(key string, req *fasthttp.Request, resp *fasthttp.Response, now time.Time) (*cacheEntry, bool) {
+	if !cacheableStatus(resp.StatusCode()) {
+		return nil, false
+	}
+	cacheControl := parseCacheControl(resp.Header.Peek(fasthttp.HeaderCacheControl))
+	if _, ok := cacheControl["no-store"]; ok {
+		return nil, false
+	}
+	if _, ok := cacheControl["private"]; ok {
+		return nil, false
+	}
+	_, public := cacheControl["public"]
+	_, sMaxAge := cacheControl["s-maxage"]
+	if c.authenticated && !public && !sMaxAge {
+		return nil, false
+	}
+	if len(req.Header.Peek(fasthttp.HeaderAuthorization)) != 0 {
+		// A shared cache stores the responses to authorized requests only if explicitly allowed, RFC 9111 section 3.5
+		_, mustRevalidate := cacheControl["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil, false
+		}
+	}
+	if len(resp.Header.Peek(fasthttp.HeaderSetCookie)) != 0 {
+		return nil, false
+	}
+	if int64(len(resp.Body())) > c.conf.MaxEntrySize {
+		return nil, false
+	}
+
+	entry := &cacheEntry{
+		Key:          key,
+		Status:       resp.StatusCode(),
+		Stored:       now,
+		ETag:         string(resp.Header.Peek(fasthttp.HeaderETag)),
+		LastModified: string(resp.Header.Peek(fasthttp.HeaderLastModified)),
+	}
+	for _, name := range strings.Split(string(resp.Header.Peek(fasthttp.HeaderVary)), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "*" {
+			return nil, false
+		}
+		if entry.Vary == nil {
+			entry.Vary = map[string]string{}
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		entry.Vary[name] = string(req.Header.Peek(name))
+	}
+
+	lifetime := c.freshnessLifetime(resp, cacheControl, now)
+	if lifetime <= 0 && entry.ETag == "" && entry.LastModified == "" {
+		// Nothing to serve without going to the upstream
+		return nil, false
+	}
+	if age, err := strconv.Atoi(string(resp.Header.Peek(fasthttp.HeaderAge))); err == nil && age > 0 {
+		entry.InitialAge = time.Duration(age) * time.Second
+	}
+	entry.Expires = now.Add(lifetime - entry.InitialAge)
+	entry.StaleWhileRevalidate, entry.StaleIfError = c.staleWindows(cacheControl, lifetime)
+
+	size := len(key) + len(resp.Body())
+	resp.Header.VisitAll(func(k, v []byte) {
+		if cacheSkipHeader(string(k)) {
+			return
+		}
+		entry.Header = append(entry.Header, [2]string{string(k), string(v)})
+		size += len(k) + len(v)
+	})
+	entry.Size = int64(size)
+	return entry, true
+}
+
+// freshnessLifetime returns how long the response is fresh, RFC 9111 section 4.2.1.
+func (c *cache) freshnessLifetime(resp *fasthttp.Response, cacheControl map[string]string, now time.Time) time.Duration {
+	if _, ok := cacheControl["no-cache"]; ok {
+		return 0
+	}
+	if v, ok := cacheControl["s-maxage"]; ok {
+		return parseSeconds(v)
+	}
+	if v, ok := cacheControl["max-age"]; ok {
+		return parseSeconds(v)
+	}
+	if expires := resp.Header.Peek(fasthttp.HeaderExpires); len(expires) != 0 {
+		t, err := http.ParseTime(string(expires))
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(string(resp.Header.Peek(fasthttp.HeaderDate))); err == nil {
+			date = d
+		}
+		return t.Sub(date)
+	}
+	return c.conf.DefaultTTL
+}
+
+// staleWindows returns how long the entry can be served stale, RFC 5861,
+// the directives of the response take precedence over the config.
+func (c *cache) staleWindows(cacheControl map[string]string, lifetime time.Duration) (time.Duration, time.Duration) {
+	if lifetime <= 0 {
+		return 0, 0
+	}
+	_, mustRevalidate := cacheControl["must-revalidate"]
+	_, proxyRevalidate := cacheControl["proxy-revalidate"]
+	if mustRevalidate || proxyRevalidate {
+		return 0, 0
+	}
+	staleWhileRevalidate := c.conf.StaleWhileRevalidate
+	if v, ok := cacheControl["stale-while-revalidate"]; ok {
+		staleWhileRevalidate = parseSeconds(v)
+	}
+	staleIfError := c.conf.StaleIfError
+	if v, ok := cacheControl["stale-if-error"]; ok {
+		staleIfError = parseSeconds(v)
+	}
+	return staleWhileRevalidate, staleIfError
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+// setConditions makes the request conditional to revalidate the entry.
+func (e *cacheEntry) setConditions(req *fasthttp.Request) {
+	if e.ETag != "" {
+		req.Header.Set(fasthttp.HeaderIfNoneMatch, e.ETag)
+	}
+	if e.LastModified != "" {
+		req.Header.Set(fasthttp.HeaderIfModifiedSince, e.LastModified)
+	}
+}
+
+// serve writes the entry as the response of the cache.
+func (e *cacheEntry) serve(resp *fasthttp.Response, body []byte, now time.Time, state string) {
+	e.write(resp, body)
+	resp.Header.Set(fasthttp.HeaderAge, strconv.Itoa(int(e.age(now).Seconds())))
+	resp.Header.Set(headerXCache, state)
+}
+
+func (e *cacheEntry) write(resp *fasthttp.Response, body []byte) {
+	resp.Reset()
+	resp.SetStatusCode(e.Status)
+	for _, h := range e.Header {
+		resp.Header.Add(h[0], h[1])
+	}
+	resp.SetBody(body)
+}
+
+// notModified turns the response to 304 if it matches the conditions of the client.
+func notModified(resp *fasthttp.Response, ifNoneMatch, ifModifiedSince string) {
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return
+	}
+	match := false
+	if ifNoneMatch != "" {
+		match = etagMatch(ifNoneMatch, string(resp.Header.Peek(fasthttp.HeaderETag)))
+	} else if ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return
+		}
+		lastModified, err := http.ParseTime(string(resp.Header.Peek(fasthttp.HeaderLastModified)))
+		if err != nil {
+			return
+		}
+		match = !lastModified.After(since)
+	}
+	if !match {
+		return
+	}
+	resp.SetStatusCode(fasthttp.StatusNotModified)
+	resp.ResetBody()
+}
+
+// etagMatch is the weak comparison of If-None-Match, RFC 9110 section 13.1.2.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheableStatus(code int) bool {
+	switch code {
+	case fasthttp.StatusOK,
+		fasthttp.StatusNonAuthoritativeInfo,
+		fasthttp.StatusMultipleChoices,
+		fasthttp.StatusMovedPermanently,
+		fasthttp.StatusPermanentRedirect,
+		fasthttp.StatusNotFound,
+		fasthttp.StatusGone:
+		return true
+	}
+	return false
+}
+
+// cacheSkipHeader reports whether the header is not stored with the entry.
+func cacheSkipHeader(key string) bool {
+	switch key {
+	case fasthttp.HeaderConnection,
+		fasthttp.HeaderKeepAlive,
+		fasthttp.HeaderTransferEncoding,
+		fasthttp.HeaderContentLength,
+		fasthttp.HeaderSetCookie,
+		fasthttp.HeaderAge,
+		headerXCache:
+		return true
+	}
+	return false
+}
+
+// parseCacheControl returns the directives of the Cache-Control header.
+func parseCacheControl(value []byte) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(string(value), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		directives[key] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
+
+func parseSeconds(s string) time.Duration {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
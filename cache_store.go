@@ -0,0 +1,298 @@
+package easiest
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheStore is the backend of the cache.
+type cacheStore interface {
+	get(key string) (*cacheEntry, []byte, bool)
+	set(entry *cacheEntry, body []byte) error
+	delete(key string) bool
+	entries() []*cacheEntry
+}
+
+// lru is the index of the entries in the order of use, it's not safe for concurrent use.
+type lru struct {
+	maxSize int64
+	size    int64
+	list    *list.List
+	items   map[string]*list.Element
+}
+
+func newLRU(maxSize int64) *lru {
+	return &lru{
+		maxSize: maxSize,
+		list:    list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+func (l *lru) get(key string) (*cacheEntry, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.list.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+// add puts the entry in front, and returns the entries evicted to fit the size.
+func (l *lru) add(entry *cacheEntry) []*cacheEntry {
+	var evicted []*cacheEntry
+	if old := l.remove(entry.Key); old != nil {
+		evicted = append(evicted, old)
+	}
+	l.items[entry.Key] = l.list.PushFront(entry)
+	l.size += entry.Size
+	for l.size > l.maxSize {
+		elem := l.list.Back()
+		if elem == nil {
+			break
+		}
+		old := elem.Value.(*cacheEntry)
+		if old == entry {
+			break
+		}
+		l.remove(old.Key)
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) *cacheEntry {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	l.list.Remove(elem)
+	delete(l.items, key)
+	entry := elem.Value.(*cacheEntry)
+	l.size -= entry.Size
+	return entry
+}
+
+func (l *lru) entries() []*cacheEntry {
+	entries := make([]*cacheEntry, 0, len(l.items))
+	for elem := l.list.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*cacheEntry))
+	}
+	return entries
+}
+
+// memoryCache keeps the bodies in memory.
+type memoryCache struct {
+	mut    sync.Mutex
+	lru    *lru
+	bodies map[string][]byte
+}
+
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{
+		lru:    newLRU(maxSize),
+		bodies: map[string][]byte{},
+	}
+}
+
+func (c *memoryCache) get(key string) (*cacheEntry, []byte, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	entry, ok := c.lru.get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	return entry, c.bodies[key], true
+}
+
+func (c *memoryCache) set(entry *cacheEntry, body []byte) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, old := range c.lru.add(entry) {
+		delete(c.bodies, old.Key)
+	}
+	c.bodies[entry.Key] = body
+	return nil
+}
+
+func (c *memoryCache) delete(key string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.bodies, key)
+	return c.lru.remove(key) != nil
+}
+
+func (c *memoryCache) entries() []*cacheEntry {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.lru.entries()
+}
+
+// diskCache keeps the bodies in the files of the dir,
+// each file is the entry as JSON in the first line followed by the body.
+type diskCache struct {
+	dir string
+	mut sync.Mutex
+	lru *lru
+}
+
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir: dir,
+		lru: newLRU(maxSize),
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type diskFile struct {
+		name    string
+		modTime time.Time
+	}
+	diskFiles := make([]diskFile, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		diskFiles = append(diskFiles, diskFile{
+			name:    filepath.Join(dir, file.Name()),
+			modTime: info.ModTime(),
+		})
+	}
+	// The oldest written are added first, so they're the first evicted
+	sort.Slice(diskFiles, func(i, j int) bool {
+		return diskFiles[i].modTime.Before(diskFiles[j].modTime)
+	})
+	for _, file := range diskFiles {
+		entry, err := readCacheEntry(file.name)
+		if err != nil || c.file(entry.Key) != file.name || entry.Size > maxSize {
+			os.Remove(file.name)
+			continue
+		}
+		for _, old := range c.lru.add(entry) {
+			os.Remove(c.file(old.Key))
+		}
+	}
+	return c, nil
+}
+
+func readCacheEntry(name string) (*cacheEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var entry cacheEntry
+	err = json.Unmarshal(line, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (c *diskCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) get(key string) (*cacheEntry, []byte, bool) {
+	c.mut.Lock()
+	_, ok := c.lru.get(key)
+	c.mut.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	// The entry is taken from the file, it may be replaced since the index is looked up
+	data, err := os.ReadFile(c.file(key))
+	if err != nil {
+		c.delete(key)
+		return nil, nil, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		c.delete(key)
+		return nil, nil, false
+	}
+	var entry cacheEntry
+	err = json.Unmarshal(data[:i], &entry)
+	if err != nil || entry.Key != key {
+		c.delete(key)
+		return nil, nil, false
+	}
+	return &entry, data[i+1:], true
+}
+
+func (c *diskCache) set(entry *cacheEntry, body []byte) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.MultiReader(bytes.NewReader(meta), strings.NewReader("\n"), bytes.NewReader(body)))
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write cache: %w", err)
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	err = os.Rename(f.Name(), c.file(entry.Key))
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write cache: %w", err)
+	}
+	for _, old := range c.lru.add(entry) {
+		if old.Key != entry.Key {
+			os.Remove(c.file(old.Key))
+		}
+	}
+	return nil
+}
+
+func (c *diskCache) delete(key string) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.lru.remove(key) == nil {
+		return false
+	}
+	os.Remove(c.file(key))
+	return true
+}
+
+func (c *diskCache) entries() []*cacheEntry {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.lru.entries()
+}
@@ -0,0 +1,379 @@
+package easiest
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// fakeUpstream answers with the headers and counts the requests.
+type fakeUpstream struct {
+	header map[string]string
+	body   string
+	calls  int
+	// conditional is the If-None-Match of the last request
+	conditional string
+	err         error
+}
+
+func (u *fakeUpstream) fetch(req *fasthttp.Request, resp *fasthttp.Response) error {
+	u.calls++
+	if u.err != nil {
+		return u.err
+	}
+	u.conditional = string(req.Header.Peek(fasthttp.HeaderIfNoneMatch))
+	resp.Reset()
+	for key, value := range u.header {
+		resp.Header.Set(key, value)
+	}
+	if u.conditional != "" && u.conditional == u.header[fasthttp.HeaderETag] {
+		resp.SetStatusCode(fasthttp.StatusNotModified)
+		return nil
+	}
+	resp.SetStatusCode(fasthttp.StatusOK)
+	resp.SetBodyString(u.body)
+	return nil
+}
+
+func cacheGet(t *testing.T, c *cache, upstream *fakeUpstream, headers map[string]string) (int, string, string) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI("http://example.com/a")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	err := c.do("example.com/a", req, resp, upstream.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode(), string(resp.Body()), string(resp.Header.Peek(headerXCache))
+}
+
+func Test_cache_do(t *testing.T) {
+	for _, backend := range []string{"memory", "disk"} {
+		t.Run(backend, func(t *testing.T) {
+			c, err := newCache(CacheConfig{
+				Backend: backend,
+				Dir:     t.TempDir(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := &fakeUpstream{
+				header: map[string]string{
+					fasthttp.HeaderCacheControl: "max-age=60",
+					fasthttp.HeaderETag:         `"v1"`,
+				},
+				body: "hello",
+			}
+
+			if _, body, state := cacheGet(t, c, upstream, nil); body != "hello" || state != "MISS" {
+				t.Fatalf("first = %q %q, want miss", body, state)
+			}
+			if _, body, state := cacheGet(t, c, upstream, nil); body != "hello" || state != "HIT" {
+				t.Fatalf("second = %q %q, want hit", body, state)
+			}
+			if upstream.calls != 1 {
+				t.Fatalf("upstream calls = %d, want 1", upstream.calls)
+			}
+
+			// The client revalidates with the cache
+			if code, _, _ := cacheGet(t, c, upstream, map[string]string{fasthttp.HeaderIfNoneMatch: `"v1"`}); code != fasthttp.StatusNotModified {
+				t.Fatalf("conditional = %d, want 304", code)
+			}
+
+			// The cache revalidates with the upstream
+			if _, body, state := cacheGet(t, c, upstream, map[string]string{fasthttp.HeaderCacheControl: "no-cache"}); body != "hello" || state != "REVALIDATED" {
+				t.Fatalf("no-cache = %q %q, want revalidated", body, state)
+			}
+			if upstream.conditional != `"v1"` {
+				t.Fatalf("upstream If-None-Match = %q, want %q", upstream.conditional, `"v1"`)
+			}
+
+			// Not stored
+			upstream.header[fasthttp.HeaderCacheControl] = "no-store"
+			upstream.header[fasthttp.HeaderETag] = `"v2"`
+			upstream.body = "changed"
+			if _, body, state := cacheGet(t, c, upstream, map[string]string{fasthttp.HeaderCacheControl: "no-cache"}); body != "changed" || state != "MISS" {
+				t.Fatalf("no-store = %q %q, want miss", body, state)
+			}
+		})
+	}
+}
+
+// expire makes the entries of the memory cache stale.
+func expire(c *cache) {
+	for _, entry := range c.store.entries() {
+		entry.Expires = time.Now().Add(-time.Second)
+	}
+}
+
+func Test_cache_stale(t *testing.T) {
+	c, err := newCache(CacheConfig{
+		StaleIfError: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeUpstream{
+		header: map[string]string{
+			fasthttp.HeaderCacheControl: "max-age=60",
+		},
+		body: "v1",
+	}
+	cacheGet(t, c, upstream, nil)
+	expire(c)
+
+	upstream.err = errors.New("connection refused")
+	if _, body, state := cacheGet(t, c, upstream, nil); body != "v1" || state != "STALE" {
+		t.Fatalf("stale if error = %q %q, want stale", body, state)
+	}
+
+	// The directive of the response takes precedence
+	upstream.err = nil
+	upstream.header[fasthttp.HeaderCacheControl] = "max-age=60, stale-while-revalidate=60"
+	cacheGet(t, c, upstream, map[string]string{fasthttp.HeaderCacheControl: "no-cache"})
+	expire(c)
+	upstream.body = "v2"
+	if _, body, state := cacheGet(t, c, upstream, nil); body != "v1" || state != "STALE" {
+		t.Fatalf("stale while revalidate = %q %q, want stale", body, state)
+	}
+	for i := 0; ; i++ {
+		_, body, _ := cacheGet(t, c, upstream, nil)
+		if body == "v2" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_cache_collapse(t *testing.T) {
+	c, err := newCache(CacheConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	fetch := func(req *fasthttp.Request, resp *fasthttp.Response) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		resp.Header.Set(fasthttp.HeaderCacheControl, "max-age=60")
+		resp.SetBodyString("hello")
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i != 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			err := c.do("example.com/a", req, resp, fetch)
+			if err != nil || string(resp.Body()) != "hello" {
+				t.Errorf("do() = %q, %v", resp.Body(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls)
+	}
+}
+
+func Test_cache_freshnessLifetime(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   time.Duration
+	}{
+		{
+			name:   "max-age",
+			header: map[string]string{fasthttp.HeaderCacheControl: "public, max-age=60"},
+			want:   time.Minute,
+		},
+		{
+			name:   "s-maxage",
+			header: map[string]string{fasthttp.HeaderCacheControl: "max-age=60, s-maxage=120"},
+			want:   2 * time.Minute,
+		},
+		{
+			name:   "no-cache",
+			header: map[string]string{fasthttp.HeaderCacheControl: "no-cache, max-age=60"},
+			want:   0,
+		},
+		{
+			name: "expires",
+			header: map[string]string{
+				fasthttp.HeaderDate:    "Sat, 01 Jan 2022 00:00:00 GMT",
+				fasthttp.HeaderExpires: "Sat, 01 Jan 2022 01:00:00 GMT",
+			},
+			want: time.Hour,
+		},
+		{
+			name:   "invalid expires",
+			header: map[string]string{fasthttp.HeaderExpires: "0"},
+			want:   0,
+		},
+		{
+			name: "default",
+			want: time.Second,
+		},
+	}
+	c := &cache{conf: CacheConfig{DefaultTTL: time.Second}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			for key, value := range tt.header {
+				resp.Header.Set(key, value)
+			}
+			cacheControl := parseCacheControl(resp.Header.Peek(fasthttp.HeaderCacheControl))
+			if got := c.freshnessLifetime(resp, cacheControl, now); got != tt.want {
+				t.Errorf("freshnessLifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_lru_add(t *testing.T) {
+	l := newLRU(10)
+	l.add(&cacheEntry{Key: "a", Size: 4})
+	l.add(&cacheEntry{Key: "b", Size: 4})
+	l.get("a")
+	evicted := l.add(&cacheEntry{Key: "c", Size: 4})
+	if len(evicted) != 1 || evicted[0].Key != "b" {
+		t.Fatalf("evicted = %v, want b", evicted)
+	}
+	if l.size != 8 {
+		t.Fatalf("size = %d, want 8", l.size)
+	}
+}
+
+func Test_cache_authenticated(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		want         string
+	}{
+		{
+			name: "default ttl",
+			want: "bob",
+		},
+		{
+			name:         "max-age",
+			cacheControl: "max-age=60",
+			want:         "bob",
+		},
+		{
+			name:         "public",
+			cacheControl: "public, max-age=60",
+			want:         "alice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCache(CacheConfig{
+				DefaultTTL: time.Minute,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.authenticated = true
+			// The upstream personalizes the response with the forwarded identity
+			fetch := func(req *fasthttp.Request, resp *fasthttp.Response) error {
+				if tt.cacheControl != "" {
+					resp.Header.Set(fasthttp.HeaderCacheControl, tt.cacheControl)
+				}
+				resp.SetBody(req.Header.Peek("X-Auth-Request-User"))
+				return nil
+			}
+			var got string
+			for _, user := range []string{"alice", "bob"} {
+				req := fasthttp.AcquireRequest()
+				resp := fasthttp.AcquireResponse()
+				req.SetRequestURI("http://example.com/me")
+				req.Header.Set("X-Auth-Request-User", user)
+				err := c.do("example.com/me", req, resp, fetch)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(resp.Body())
+				fasthttp.ReleaseRequest(req)
+				fasthttp.ReleaseResponse(resp)
+			}
+			if got != tt.want {
+				t.Errorf("second user got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cache_set_tooLarge(t *testing.T) {
+	c, err := newCache(CacheConfig{
+		MaxSize: 256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeUpstream{
+		header: map[string]string{fasthttp.HeaderCacheControl: "max-age=60"},
+		body:   "small",
+	}
+	cacheGet(t, c, upstream, nil)
+	if len(c.store.entries()) != 1 {
+		t.Fatal("small entry is not stored")
+	}
+	// The body fits the max entry size but not with its headers
+	upstream.header["X-Padding"] = strings.Repeat("x", 256)
+	cacheGet(t, c, upstream, map[string]string{fasthttp.HeaderCacheControl: "no-cache"})
+	if entries := c.store.entries(); len(entries) != 1 || entries[0].Size > 256 {
+		t.Errorf("entries = %v, want the small entry kept", entries)
+	}
+}
+
+func Test_newDiskCache_order(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, key := range []string{"b", "a", "c"} {
+		err := store.set(&cacheEntry{Key: key, Size: 300}, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The written order is kept by the mtime, unlike the order of the names
+		mtime := now.Add(time.Duration(i) * time.Second)
+		err = os.Chtimes(store.file(key), mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err = newDiskCache(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.set(&cacheEntry{Key: "d", Size: 300}, []byte("d"))
+	var keys []string
+	for _, entry := range store.entries() {
+		keys = append(keys, entry.Key)
+	}
+	if got := strings.Join(keys, ","); got != "d,c,a" {
+		t.Errorf("keys = %s, want d,c,a", got)
+	}
+}
@@ -0,0 +1,187 @@
+package easiest
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	headerClientVerify      = "X-Client-Verify"
+	headerClientSubject     = "X-Client-Subject"
+	headerClientSAN         = "X-Client-SAN"
+	headerClientFingerprint = "X-Client-Fingerprint"
+)
+
+var (
+	errClientCertDenied   = errors.New("client certificate not allowed")
+	errClientCertRequired = errors.New("client certificate required")
+)
+
+// clientAuth verifies the client certificates of a route.
+type clientAuth struct {
+	conf      ClientAuthConfig
+	clientCAs *x509.CertPool
+}
+
+func newClientAuth(conf ClientAuthConfig) (*clientAuth, error) {
+	switch conf.Mode {
+	case "", "require", "optional":
+	default:
+		return nil, fmt.Errorf("unsupported mode %q", conf.Mode)
+	}
+	if conf.CA == "" {
+		return nil, fmt.Errorf("ca is required")
+	}
+	data, err := os.ReadFile(conf.CA)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %q", conf.CA)
+	}
+	for _, pattern := range append(conf.AllowedSubjects, conf.AllowedSANs...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	return &clientAuth{
+		conf:      conf,
+		clientCAs: clientCAs,
+	}, nil
+}
+
+// tlsConfig returns the base config requesting the client certificates.
+func (c *clientAuth) tlsConfig(base *tls.Config) *tls.Config {
+	conf := base.Clone()
+	conf.GetConfigForClient = nil
+	conf.ClientCAs = c.clientCAs
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.conf.Mode == "optional" {
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	conf.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		if !c.allowed(state.PeerCertificates[0]) {
+			return errClientCertDenied
+		}
+		return nil
+	}
+	return conf
+}
+
+// allowed reports whether the certificate matches the allowed subjects or SANs,
+// any verified certificate is allowed when neither is set.
+func (c *clientAuth) allowed(cert *x509.Certificate) bool {
+	if len(c.conf.AllowedSubjects) == 0 && len(c.conf.AllowedSANs) == 0 {
+		return true
+	}
+	if matchAny(c.conf.AllowedSubjects, cert.Subject.CommonName, cert.Subject.String()) {
+		return true
+	}
+	if matchAny(c.conf.AllowedSANs, certSANs(cert)...) {
+		return true
+	}
+	return false
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certSANs returns the subject alternative names of the certificate.
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// setHeaders removes the headers of the client certificate sent by the client,
+// and sets them from the certificate if they're forwarded.
+func (c *clientAuth) setHeaders(req *fasthttp.Request, state *tls.ConnectionState) {
+	req.Header.Del(headerClientVerify)
+	req.Header.Del(headerClientSubject)
+	req.Header.Del(headerClientSAN)
+	req.Header.Del(headerClientFingerprint)
+	if c.conf.ForwardHeaders {
+		c.forwardHeaders(req, state)
+	}
+}
+
+// forwardHeaders sets the identity of the client certificate to the request.
+func (c *clientAuth) forwardHeaders(req *fasthttp.Request, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		req.Header.Set(headerClientVerify, "NONE")
+		return
+	}
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	req.Header.Set(headerClientVerify, "SUCCESS")
+	req.Header.Set(headerClientSubject, cert.Subject.String())
+	if sans := certSANs(cert); len(sans) != 0 {
+		req.Header.Set(headerClientSAN, strings.Join(sans, ", "))
+	}
+	req.Header.Set(headerClientFingerprint, hex.EncodeToString(fingerprint[:]))
+}
+
+// verified checks the client certificate after the handshake,
+// the ACME challenges and the missing certificates of the required mode are refused.
+func (c *clientAuth) verified(state *tls.ConnectionState) error {
+	if state == nil || state.NegotiatedProtocol == acme.ALPNProto {
+		return errClientCertRequired
+	}
+	if c.conf.Mode != "optional" && len(state.PeerCertificates) == 0 {
+		return errClientCertRequired
+	}
+	return nil
+}
+
+// withClientAuth selects the config of the route by the SNI,
+// the ACME challenges keep the base config since they come without client certificates,
+// a hello is only a challenge if it offers no other protocol.
+func withClientAuth(base *tls.Config, routes map[string]*routeEntry) *tls.Config {
+	configs := map[string]*tls.Config{}
+	for domain, route := range routes {
+		if route.clientAuth != nil {
+			configs[strings.ToLower(domain)] = route.clientAuth.tlsConfig(base)
+		}
+	}
+	if len(configs) == 0 {
+		return base
+	}
+	conf := base.Clone()
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+			return nil, nil
+		}
+		return configs[strings.ToLower(hello.ServerName)], nil
+	}
+	return conf
+}
@@ -0,0 +1,255 @@
+package easiest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/acme"
+)
+
+func Test_clientAuth_allowed(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/service/api")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   "api.internal",
+			Organization: []string{"Example"},
+		},
+		DNSNames:    []string{"api.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:        []*url.URL{spiffe},
+	}
+	tests := []struct {
+		name string
+		conf ClientAuthConfig
+		want bool
+	}{
+		{
+			name: "any",
+			want: true,
+		},
+		{
+			name: "common name",
+			conf: ClientAuthConfig{AllowedSubjects: []string{"*.internal"}},
+			want: true,
+		},
+		{
+			name: "distinguished name",
+			conf: ClientAuthConfig{AllowedSubjects: []string{"CN=api.internal,O=Example"}},
+			want: true,
+		},
+		{
+			name: "subject mismatch",
+			conf: ClientAuthConfig{AllowedSubjects: []string{"web.internal"}},
+			want: false,
+		},
+		{
+			name: "dns san",
+			conf: ClientAuthConfig{AllowedSANs: []string{"*.example.com"}},
+			want: true,
+		},
+		{
+			name: "ip san",
+			conf: ClientAuthConfig{AllowedSANs: []string{"10.0.0.1"}},
+			want: true,
+		},
+		{
+			name: "uri san",
+			conf: ClientAuthConfig{AllowedSANs: []string{"spiffe://example.com/service/*"}},
+			want: true,
+		},
+		{
+			name: "san mismatch",
+			conf: ClientAuthConfig{AllowedSubjects: []string{"web.internal"}, AllowedSANs: []string{"*.example.org"}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientAuth{conf: tt.conf}
+			if got := c.allowed(cert); got != tt.want {
+				t.Errorf("allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_clientAuth_setHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		conf ClientAuthConfig
+		want string
+	}{
+		{
+			name: "not forwarded",
+		},
+		{
+			name: "forwarded",
+			conf: ClientAuthConfig{ForwardHeaders: true},
+			want: "NONE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			// Injected by the client
+			req.Header.Set(headerClientVerify, "SUCCESS")
+			req.Header.Set(headerClientSubject, "CN=admin")
+			req.Header.Set(headerClientSAN, "admin.example.com")
+			req.Header.Set(headerClientFingerprint, "00")
+
+			c := &clientAuth{conf: tt.conf}
+			c.setHeaders(req, nil)
+			if got := string(req.Header.Peek(headerClientVerify)); got != tt.want {
+				t.Errorf("%s = %q, want %q", headerClientVerify, got, tt.want)
+			}
+			for _, name := range []string{headerClientSubject, headerClientSAN, headerClientFingerprint} {
+				if got := req.Header.Peek(name); len(got) != 0 {
+					t.Errorf("%s = %q, want removed", name, got)
+				}
+			}
+		})
+	}
+}
+
+// newTestCertificate returns a self-signed certificate for the host.
+func newTestCertificate(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func Test_withClientAuth_acme(t *testing.T) {
+	cert := newTestCertificate(t, "a.test")
+	base := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1", acme.ALPNProto},
+	}
+	route := &routeEntry{
+		clientAuth: &clientAuth{
+			conf:      ClientAuthConfig{Mode: "require"},
+			clientCAs: x509.NewCertPool(),
+		},
+	}
+	conf := withClientAuth(base, map[string]*routeEntry{"a.test": route})
+
+	tests := []struct {
+		name          string
+		protos        []string
+		wantHandshake bool
+	}{
+		{
+			name:          "challenge",
+			protos:        []string{acme.ALPNProto},
+			wantHandshake: true,
+		},
+		{
+			name:   "mixed",
+			protos: []string{"http/1.1", acme.ALPNProto},
+		},
+		{
+			name:   "http",
+			protos: []string{"http/1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			go func() {
+				client := tls.Client(clientConn, &tls.Config{
+					ServerName:         "a.test",
+					NextProtos:         tt.protos,
+					InsecureSkipVerify: true,
+				})
+				client.Handshake()
+				// Reads the alert of the server, if any
+				client.Read(make([]byte, 1))
+			}()
+
+			server := tls.Server(serverConn, conf)
+			err := server.Handshake()
+			if (err == nil) != tt.wantHandshake {
+				t.Fatalf("Handshake() error = %v, wantHandshake %v", err, tt.wantHandshake)
+			}
+			if err != nil {
+				return
+			}
+			state := server.ConnectionState()
+			if err := route.clientAuth.verified(&state); err == nil {
+				t.Errorf("verified() = nil, want the connection refused")
+			}
+		})
+	}
+}
+
+func Test_clientAuth_verified(t *testing.T) {
+	peer := []*x509.Certificate{{}}
+	tests := []struct {
+		name    string
+		mode    string
+		state   *tls.ConnectionState
+		wantErr bool
+	}{
+		{
+			name:    "no state",
+			state:   nil,
+			wantErr: true,
+		},
+		{
+			name:  "require",
+			state: &tls.ConnectionState{PeerCertificates: peer},
+		},
+		{
+			name:    "require without certificate",
+			state:   &tls.ConnectionState{},
+			wantErr: true,
+		},
+		{
+			name:  "optional without certificate",
+			mode:  "optional",
+			state: &tls.ConnectionState{},
+		},
+		{
+			name:    "acme",
+			mode:    "optional",
+			state:   &tls.ConnectionState{NegotiatedProtocol: acme.ALPNProto},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientAuth{conf: ClientAuthConfig{Mode: tt.mode}}
+			if err := c.verified(tt.state); (err != nil) != tt.wantErr {
+				t.Errorf("verified() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
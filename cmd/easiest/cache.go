@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const cacheUsage = "usage: easiest cache [-c config] [-addr address] list [-route route] | purge [-url url] [-prefix prefix] [-route route]"
+
+// cacheCommand lists or purges the cache with the debug server.
+func cacheCommand(args []string) error {
+	set := flag.NewFlagSet("cache", flag.ContinueOnError)
+	conf := set.String("c", config, "route config")
+	addr := set.String("addr", "", "debug address, default is the debugAddress of the config")
+	err := set.Parse(args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() == 0 {
+		return errors.New(cacheUsage)
+	}
+
+	if *addr == "" {
+		c, err := loadConfig(*conf)
+		if err != nil {
+			return err
+		}
+		if c.DebugAddress == "" {
+			return fmt.Errorf("no debugAddress in the config")
+		}
+		*addr = c.DebugAddress
+	}
+
+	sub := flag.NewFlagSet(set.Arg(0), flag.ContinueOnError)
+	route := sub.String("route", "", "route domain or listen address")
+	u := sub.String("url", "", "url to purge")
+	prefix := sub.String("prefix", "", "url prefix to purge")
+	err = sub.Parse(set.Args()[1:])
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	if *route != "" {
+		query.Set("route", *route)
+	}
+
+	method := http.MethodGet
+	path := "/debug/cache"
+	switch set.Arg(0) {
+	case "list":
+	case "purge":
+		method = http.MethodPost
+		path = "/debug/cache/purge"
+		if *u != "" {
+			query.Set("url", *u)
+		}
+		if *prefix != "" {
+			query.Set("prefix", *prefix)
+		}
+	default:
+		return errors.New(cacheUsage)
+	}
+
+	req, err := http.NewRequest(method, debugURL(*addr, path, query), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var out bytes.Buffer
+	err = json.Indent(&out, body, "", "  ")
+	if err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func debugURL(addr, path string, query url.Values) string {
+	host := addr
+	if len(host) > 0 && host[0] == ':' {
+		host = "127.0.0.1" + host
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 
 	"github.com/wzshiming/easiest"
@@ -24,21 +26,36 @@ func init() {
 func main() {
 	logger := log.New(os.Stderr, "[easiest] ", log.LstdFlags)
 
-	data, err := os.ReadFile(config)
-	if err != nil {
-		logger.Println("read config: ", err)
-		os.Exit(1)
+	switch flag.Arg(0) {
+	case "sign":
+		err := sign(flag.Args()[1:])
+		if err != nil {
+			logger.Println("sign: ", err)
+			os.Exit(1)
+		}
+		return
+	case "cache":
+		err := cacheCommand(flag.Args()[1:])
+		if err != nil {
+			logger.Println("cache: ", err)
+			os.Exit(1)
+		}
+		return
 	}
-	var conf easiest.Config
-	err = yaml.Unmarshal(data, &conf)
+
+	conf, err := loadConfig(config)
 	if err != nil {
-		logger.Println("unmarshal config: ", err)
+		logger.Println(err)
 		os.Exit(1)
 	}
-	data, _ = yaml.Marshal(conf)
+	data, _ := yaml.Marshal(redactConfig(conf))
 	os.Stderr.Write(data)
 
-	server := easiest.NewServer(conf, logger)
+	server, err := easiest.NewServer(conf, logger)
+	if err != nil {
+		logger.Println("new server: ", err)
+		os.Exit(1)
+	}
 
 	err = server.Run(context.Background())
 	if err != nil {
@@ -46,3 +63,60 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func loadConfig(config string) (easiest.Config, error) {
+	var conf easiest.Config
+	data, err := os.ReadFile(config)
+	if err != nil {
+		return conf, fmt.Errorf("read config: %w", err)
+	}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return conf, fmt.Errorf("unmarshal config: %w", err)
+	}
+	return conf, nil
+}
+
+const redacted = "REDACTED"
+
+// redactConfig returns a copy of the config without the secrets, to be printed.
+func redactConfig(conf easiest.Config) easiest.Config {
+	conf.Routes = append([]easiest.Route(nil), conf.Routes...)
+	for i := range conf.Routes {
+		r := &conf.Routes[i]
+		if u, err := url.Parse(r.Proxy); err == nil && u.User != nil {
+			r.Proxy = u.Redacted()
+		}
+		if r.Auth != nil {
+			auth := *r.Auth
+			if len(auth.Users) != 0 {
+				auth.Users = make(map[string]string, len(r.Auth.Users))
+				for user := range r.Auth.Users {
+					auth.Users[user] = redacted
+				}
+			}
+			if len(auth.Tokens) != 0 {
+				auth.Tokens = []string{redacted}
+			}
+			r.Auth = &auth
+		}
+		if r.OIDC != nil {
+			oidc := *r.OIDC
+			if oidc.ClientSecret != "" {
+				oidc.ClientSecret = redacted
+			}
+			if oidc.CookieSecret != "" {
+				oidc.CookieSecret = redacted
+			}
+			r.OIDC = &oidc
+		}
+		if r.SignedURL != nil {
+			signedURL := *r.SignedURL
+			if signedURL.Key != "" {
+				signedURL.Key = redacted
+			}
+			r.SignedURL = &signedURL
+		}
+	}
+	return conf
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wzshiming/easiest"
+)
+
+// sign prints the URL signed with the key of its route.
+func sign(args []string) error {
+	set := flag.NewFlagSet("sign", flag.ContinueOnError)
+	conf := set.String("c", config, "route config")
+	ttl := set.Duration("ttl", time.Hour, "time to live of the signed url")
+	err := set.Parse(args)
+	if err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		return fmt.Errorf("usage: easiest sign [-c config] [-ttl duration] url")
+	}
+	rawURL := set.Arg(0)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadConfig(*conf)
+	if err != nil {
+		return err
+	}
+	for _, route := range c.Routes {
+		if !strings.EqualFold(route.Domain, u.Hostname()) {
+			continue
+		}
+		if route.SignedURL == nil {
+			return fmt.Errorf("route %q has no signed url", route.Domain)
+		}
+		signed, err := easiest.SignURL(*route.SignedURL, rawURL, time.Now().Add(*ttl))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, signed)
+		return nil
+	}
+	return fmt.Errorf("not route %q", u.Hostname())
+}
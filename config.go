@@ -1,25 +1,247 @@
 package easiest
 
+import (
+	"time"
+)
+
 type Config struct {
-	DebugAddress string  `yaml:"debugAddress,omitempty"`
-	TlsDir       string  `yaml:"tlsDir,omitempty"`
-	Routes       []Route `yaml:"routes,omitempty"`
+	DebugAddress   string              `yaml:"debugAddress,omitempty"`
+	TlsDir         string              `yaml:"tlsDir,omitempty"`
+	TrustedProxies []string            `yaml:"trustedProxies,omitempty"`
+	ProxyProtocol  ProxyProtocolConfig `yaml:"proxyProtocol,omitempty"`
+	Resolver       *ResolverConfig     `yaml:"resolver,omitempty"`
+	Timeouts       TimeoutConfig       `yaml:"timeouts,omitempty"`
+	Limits         LimitConfig         `yaml:"limits,omitempty"`
+	Bandwidth      BandwidthConfig     `yaml:"bandwidth,omitempty"`
+	Access         AccessConfig        `yaml:"access,omitempty"`
+	AccessLog      *AccessLogConfig    `yaml:"accessLog,omitempty"`
+	Routes         []Route             `yaml:"routes,omitempty"`
+}
+
+type LimitConfig struct {
+	MaxConns         int           `yaml:"maxConns,omitempty"`
+	MaxConnsPerIP    int           `yaml:"maxConnsPerIP,omitempty"`
+	MaxUpstreamConns int           `yaml:"maxUpstreamConns,omitempty"`
+	QueueTimeout     time.Duration `yaml:"queueTimeout,omitempty"`
+}
+
+type AuthConfig struct {
+	Realm            string            `yaml:"realm,omitempty"`
+	Users            map[string]string `yaml:"users,omitempty"`
+	Tokens           []string          `yaml:"tokens,omitempty"`
+	ExemptPaths      []string          `yaml:"exemptPaths,omitempty"`
+	StripCredentials bool              `yaml:"stripCredentials,omitempty"`
+}
+
+type CacheConfig struct {
+	Backend      string        `yaml:"backend,omitempty"`
+	Dir          string        `yaml:"dir,omitempty"`
+	MaxSize      int64         `yaml:"maxSize,omitempty"`
+	MaxEntrySize int64         `yaml:"maxEntrySize,omitempty"`
+	DefaultTTL   time.Duration `yaml:"defaultTTL,omitempty"`
+
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate,omitempty"`
+	StaleIfError         time.Duration `yaml:"staleIfError,omitempty"`
+}
+
+type SignedURLConfig struct {
+	Key           string `yaml:"key,omitempty"`
+	Param         string `yaml:"param,omitempty"`
+	ExpiresParam  string `yaml:"expiresParam,omitempty"`
+	Header        string `yaml:"header,omitempty"`
+	ExpiresHeader string `yaml:"expiresHeader,omitempty"`
+}
+
+type OIDCConfig struct {
+	Issuer        string        `yaml:"issuer,omitempty"`
+	ClientID      string        `yaml:"clientID,omitempty"`
+	ClientSecret  string        `yaml:"clientSecret,omitempty"`
+	Scopes        []string      `yaml:"scopes,omitempty"`
+	RedirectURL   string        `yaml:"redirectURL,omitempty"`
+	RedirectPath  string        `yaml:"redirectPath,omitempty"`
+	CookieName    string        `yaml:"cookieName,omitempty"`
+	CookieSecret  string        `yaml:"cookieSecret,omitempty"`
+	SessionTTL    time.Duration `yaml:"sessionTTL,omitempty"`
+	AllowedEmails []string      `yaml:"allowedEmails,omitempty"`
+}
+
+type ClientAuthConfig struct {
+	CA              string   `yaml:"ca,omitempty"`
+	Mode            string   `yaml:"mode,omitempty"`
+	AllowedSubjects []string `yaml:"allowedSubjects,omitempty"`
+	AllowedSANs     []string `yaml:"allowedSANs,omitempty"`
+	ForwardHeaders  bool     `yaml:"forwardHeaders,omitempty"`
+}
+
+type AccessLogConfig struct {
+	Format     string `yaml:"format,omitempty"`
+	Path       string `yaml:"path,omitempty"`
+	MaxSize    int64  `yaml:"maxSize,omitempty"`
+	MaxBackups *int   `yaml:"maxBackups,omitempty"`
+}
+
+type AccessConfig struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+type BandwidthConfig struct {
+	Rate  int64 `yaml:"rate,omitempty"`
+	Burst int64 `yaml:"burst,omitempty"`
+}
+
+type RateLimitConfig struct {
+	Rate       float64 `yaml:"rate,omitempty"`
+	Burst      int     `yaml:"burst,omitempty"`
+	Key        string  `yaml:"key,omitempty"`
+	Header     string  `yaml:"header,omitempty"`
+	PathPrefix string  `yaml:"pathPrefix,omitempty"`
+}
+
+type TimeoutConfig struct {
+	HeaderRead time.Duration `yaml:"headerRead,omitempty"`
+	Handshake  time.Duration `yaml:"handshake,omitempty"`
+	Read       time.Duration `yaml:"read,omitempty"`
+	Write      time.Duration `yaml:"write,omitempty"`
+	Idle       time.Duration `yaml:"idle,omitempty"`
+	Dial       time.Duration `yaml:"dial,omitempty"`
+	Response   time.Duration `yaml:"response,omitempty"`
+}
+
+type ResolverConfig struct {
+	Hosts    map[string]string `yaml:"hosts,omitempty"`
+	Servers  []string          `yaml:"servers,omitempty"`
+	CacheTTL time.Duration     `yaml:"cacheTTL,omitempty"`
+	Prefer   string            `yaml:"prefer,omitempty"`
+}
+
+type ProxyProtocolConfig struct {
+	Accept         bool     `yaml:"accept,omitempty"`
+	TrustedSources []string `yaml:"trustedSources,omitempty"`
 }
 
 type HttpConfig struct {
-	ForceTLS           bool `yaml:"forceTLS,omitempty"`
-	HeaderForwardedFor bool `yaml:"headerForwardedFor,omitempty"`
+	ForceTLS              bool `yaml:"forceTLS,omitempty"`
+	HeaderForwardedFor    bool `yaml:"headerForwardedFor,omitempty"`
+	HeaderForwardedProto  bool `yaml:"headerForwardedProto,omitempty"`
+	HeaderForwardedHost   bool `yaml:"headerForwardedHost,omitempty"`
+	HeaderForwardedPort   bool `yaml:"headerForwardedPort,omitempty"`
+	HeaderForwarded       bool `yaml:"headerForwarded,omitempty"`
+	HeaderRealIP          bool `yaml:"headerRealIP,omitempty"`
+	DisableDefaultHeaders bool `yaml:"disableDefaultHeaders,omitempty"`
 }
 
 type Route struct {
 	Domain   string     `yaml:"domain,omitempty"`
+	Listen   string     `yaml:"listen,omitempty"`
 	Target   string     `yaml:"target,omitempty"`
+	Targets  []string   `yaml:"targets,omitempty"`
 	HTTP     HttpConfig `yaml:"http,omitempty"`
 	Replaces []Replace  `yaml:"replaces,omitempty"`
 	Stream   bool       `yaml:"stream,omitempty"`
+
+	SendProxyProtocol int `yaml:"sendProxyProtocol,omitempty"`
+
+	Timeouts TimeoutConfig `yaml:"timeouts,omitempty"`
+	Limits   LimitConfig   `yaml:"limits,omitempty"`
+
+	RateLimits []RateLimitConfig `yaml:"rateLimits,omitempty"`
+
+	Bandwidth     BandwidthConfig `yaml:"bandwidth,omitempty"`
+	ConnBandwidth BandwidthConfig `yaml:"connBandwidth,omitempty"`
+
+	Access AccessConfig `yaml:"access,omitempty"`
+	Auth   *AuthConfig  `yaml:"auth,omitempty"`
+	OIDC   *OIDCConfig  `yaml:"oidc,omitempty"`
+
+	SignedURL *SignedURLConfig `yaml:"signedURL,omitempty"`
+
+	ClientAuth *ClientAuthConfig `yaml:"clientAuth,omitempty"`
+
+	Proxy   string   `yaml:"proxy,omitempty"`
+	NoProxy []string `yaml:"noProxy,omitempty"`
+
+	UpstreamHost string `yaml:"upstreamHost,omitempty"`
+	UpstreamSNI  string `yaml:"upstreamSNI,omitempty"`
+	PreserveHost bool   `yaml:"preserveHost,omitempty"`
+
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+
+	RequestHeaders  HeaderPolicy `yaml:"requestHeaders,omitempty"`
+	ResponseHeaders HeaderPolicy `yaml:"responseHeaders,omitempty"`
+	CORS            *CORSConfig  `yaml:"cors,omitempty"`
+}
+
+func (r Route) name() string {
+	if r.Domain != "" {
+		return r.Domain
+	}
+	return r.Listen
+}
+
+// httpOnlyOption returns the first option set that only applies to HTTP routes.
+func (r Route) httpOnlyOption() string {
+	switch {
+	case !r.RequestHeaders.empty():
+		return "request headers"
+	case !r.ResponseHeaders.empty():
+		return "response headers"
+	case r.HTTP.DisableDefaultHeaders:
+		return "disable default headers"
+	case r.CORS != nil:
+		return "cors"
+	case r.HTTP.HeaderForwardedFor, r.HTTP.HeaderForwardedProto, r.HTTP.HeaderForwardedHost,
+		r.HTTP.HeaderForwardedPort, r.HTTP.HeaderForwarded, r.HTTP.HeaderRealIP:
+		return "forwarding headers"
+	case r.Auth != nil:
+		return "auth"
+	case r.OIDC != nil:
+		return "oidc"
+	case r.SignedURL != nil:
+		return "signed url"
+	case r.Cache != nil:
+		return "cache"
+	}
+	return ""
+}
+
+// tcpOnlyOption returns the first option set that only applies to tcp routes.
+func (r Route) tcpOnlyOption() string {
+	switch {
+	case r.Proxy != "" || len(r.NoProxy) != 0:
+		return "proxy"
+	case len(r.Replaces) != 0:
+		return "replaces"
+	case r.Bandwidth != BandwidthConfig{}:
+		return "bandwidth"
+	case r.ConnBandwidth != BandwidthConfig{}:
+		return "conn bandwidth"
+	}
+	return ""
 }
 
 type Replace struct {
 	Old string `yaml:"old,omitempty"`
 	New string `yaml:"new,omitempty"`
 }
+
+type HeaderPolicy struct {
+	Set     map[string]string   `yaml:"set,omitempty"`
+	Add     map[string][]string `yaml:"add,omitempty"`
+	Remove  []string            `yaml:"remove,omitempty"`
+	Rewrite []string            `yaml:"rewrite,omitempty"`
+}
+
+func (p HeaderPolicy) empty() bool {
+	return len(p.Set) == 0 && len(p.Add) == 0 && len(p.Remove) == 0 && len(p.Rewrite) == 0
+}
+
+type CORSConfig struct {
+	AllowOrigins       []string `yaml:"allowOrigins,omitempty"`
+	AllowOriginRegexps []string `yaml:"allowOriginRegexps,omitempty"`
+	AllowMethods       []string `yaml:"allowMethods,omitempty"`
+	AllowHeaders       []string `yaml:"allowHeaders,omitempty"`
+	ExposeHeaders      []string `yaml:"exposeHeaders,omitempty"`
+	MaxAge             int      `yaml:"maxAge,omitempty"`
+	AllowCredentials   bool     `yaml:"allowCredentials,omitempty"`
+}
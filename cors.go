@@ -0,0 +1,129 @@
+package easiest
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type cors struct {
+	conf    CORSConfig
+	regexps []*regexp.Regexp
+}
+
+func newCORS(conf CORSConfig) (*cors, error) {
+	c := &cors{
+		conf: conf,
+	}
+	if conf.AllowCredentials && c.allowAnyOrigin() {
+		// Every site would get the credentialed responses
+		return nil, fmt.Errorf("allow credentials can't be used with the wildcard origin")
+	}
+	for _, pattern := range conf.AllowOriginRegexps {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.regexps = append(c.regexps, re)
+	}
+	return c, nil
+}
+
+// allowOrigin reports whether the origin is allowed.
+func (c *cors) allowOrigin(origin string) bool {
+	for _, o := range c.conf.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+		if strings.Contains(o, "*") {
+			if ok, _ := path.Match(o, origin); ok {
+				return true
+			}
+		}
+	}
+	for _, re := range c.regexps {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowAnyOrigin() bool {
+	for _, o := range c.conf.AllowOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// isPreflight reports whether the request is a CORS preflight request.
+func (c *cors) isPreflight(req *fasthttp.Request) bool {
+	return req.Header.IsOptions() &&
+		len(req.Header.Peek(fasthttp.HeaderOrigin)) != 0 &&
+		len(req.Header.Peek(fasthttp.HeaderAccessControlRequestMethod)) != 0
+}
+
+// preflight answers the preflight request without the upstream.
+func (c *cors) preflight(origin string, req *fasthttp.Request, resp *fasthttp.Response) {
+	resp.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAccessControlRequestMethod)
+	resp.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAccessControlRequestHeaders)
+	if !c.allowOrigin(origin) {
+		resp.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+		resp.SetStatusCode(fasthttp.StatusForbidden)
+		return
+	}
+	c.setAllowOrigin(origin, resp)
+
+	if len(c.conf.AllowMethods) != 0 {
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowMethods, strings.Join(c.conf.AllowMethods, ", "))
+	} else {
+		resp.Header.SetBytesV(fasthttp.HeaderAccessControlAllowMethods, req.Header.Peek(fasthttp.HeaderAccessControlRequestMethod))
+	}
+
+	if len(c.conf.AllowHeaders) != 0 {
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowHeaders, strings.Join(c.conf.AllowHeaders, ", "))
+	} else if headers := req.Header.Peek(fasthttp.HeaderAccessControlRequestHeaders); len(headers) != 0 {
+		resp.Header.SetBytesV(fasthttp.HeaderAccessControlAllowHeaders, headers)
+	}
+
+	if c.conf.MaxAge > 0 {
+		resp.Header.Set(fasthttp.HeaderAccessControlMaxAge, strconv.Itoa(c.conf.MaxAge))
+	}
+	resp.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// response sets the CORS headers of the response, replacing any sent by the upstream.
+func (c *cors) response(origin string, resp *fasthttp.Response) {
+	resp.Header.Del(fasthttp.HeaderAccessControlAllowOrigin)
+	resp.Header.Del(fasthttp.HeaderAccessControlAllowCredentials)
+	resp.Header.Del(fasthttp.HeaderAccessControlExposeHeaders)
+	if origin == "" || !c.allowOrigin(origin) {
+		return
+	}
+	c.setAllowOrigin(origin, resp)
+	if len(c.conf.ExposeHeaders) != 0 {
+		resp.Header.Set(fasthttp.HeaderAccessControlExposeHeaders, strings.Join(c.conf.ExposeHeaders, ", "))
+	}
+}
+
+func (c *cors) setAllowOrigin(origin string, resp *fasthttp.Response) {
+	if c.conf.AllowCredentials {
+		// The wildcard is not allowed with credentials, so the allowed origin is reflected
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, origin)
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowCredentials, "true")
+		resp.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+		return
+	}
+	if c.allowAnyOrigin() {
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, "*")
+		return
+	}
+	resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, origin)
+	resp.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderOrigin)
+}
@@ -0,0 +1,273 @@
+package easiest
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_cors_allowOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   CORSConfig
+		origin string
+		want   bool
+	}{
+		{
+			name: "wildcard",
+			conf: CORSConfig{
+				AllowOrigins: []string{"*"},
+			},
+			origin: "https://example.com",
+			want:   true,
+		},
+		{
+			name: "exact",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://example.com"},
+			},
+			origin: "https://example.org",
+			want:   false,
+		},
+		{
+			name: "subdomain",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://*.example.com"},
+			},
+			origin: "https://a.example.com",
+			want:   true,
+		},
+		{
+			name: "regexp",
+			conf: CORSConfig{
+				AllowOriginRegexps: []string{`^http://localhost:\d+$`},
+			},
+			origin: "http://localhost:8080",
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCORS(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.allowOrigin(tt.origin); got != tt.want {
+				t.Errorf("allowOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    CORSConfig
+		wantErr bool
+	}{
+		{
+			name: "credentials",
+			conf: CORSConfig{
+				AllowOrigins:     []string{"https://example.com"},
+				AllowCredentials: true,
+			},
+		},
+		{
+			name: "wildcard",
+			conf: CORSConfig{
+				AllowOrigins: []string{"*"},
+			},
+		},
+		{
+			name: "wildcard with credentials",
+			conf: CORSConfig{
+				AllowOrigins:     []string{"*"},
+				AllowCredentials: true,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid regexp",
+			conf: CORSConfig{
+				AllowOriginRegexps: []string{"("},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCORS(tt.conf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newCORS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_cors_preflight(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       CORSConfig
+		origin     string
+		wantStatus int
+		want       map[string]string
+	}{
+		{
+			name: "configured",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://example.com"},
+				AllowMethods: []string{"GET", "PUT"},
+				AllowHeaders: []string{"X-Token"},
+				MaxAge:       600,
+			},
+			origin:     "https://example.com",
+			wantStatus: fasthttp.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Allow-Headers": "X-Token",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name: "requested",
+			conf: CORSConfig{
+				AllowOrigins: []string{"*"},
+			},
+			origin:     "https://example.com",
+			wantStatus: fasthttp.StatusNoContent,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "PUT",
+				"Access-Control-Allow-Headers": "X-Requested",
+				"Access-Control-Max-Age":       "",
+			},
+		},
+		{
+			name: "disallowed origin",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://example.com"},
+			},
+			origin:     "https://evil.test",
+			wantStatus: fasthttp.StatusForbidden,
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCORS(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			req.Header.SetMethod(fasthttp.MethodOptions)
+			req.Header.Set(fasthttp.HeaderOrigin, tt.origin)
+			req.Header.Set(fasthttp.HeaderAccessControlRequestMethod, "PUT")
+			req.Header.Set(fasthttp.HeaderAccessControlRequestHeaders, "X-Requested")
+			if !c.isPreflight(req) {
+				t.Fatal("isPreflight() = false, want true")
+			}
+
+			c.preflight(tt.origin, req, resp)
+			if got := resp.StatusCode(); got != tt.wantStatus {
+				t.Errorf("status = %d, want %d", got, tt.wantStatus)
+			}
+			for k, v := range tt.want {
+				if got := string(resp.Header.Peek(k)); got != v {
+					t.Errorf("preflight() %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func Test_cors_response(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     CORSConfig
+		origin   string
+		want     map[string]string
+		wantVary bool
+	}{
+		{
+			name: "wildcard",
+			conf: CORSConfig{
+				AllowOrigins:  []string{"*"},
+				ExposeHeaders: []string{"X-Total"},
+			},
+			origin: "https://example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "X-Total",
+			},
+		},
+		{
+			name: "origin",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://example.com"},
+			},
+			origin: "https://example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Credentials": "",
+			},
+			wantVary: true,
+		},
+		{
+			name: "credentials",
+			conf: CORSConfig{
+				AllowOrigins:     []string{"https://*.example.com"},
+				AllowCredentials: true,
+			},
+			origin: "https://app.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+			wantVary: true,
+		},
+		{
+			name: "disallowed origin",
+			conf: CORSConfig{
+				AllowOrigins: []string{"https://example.com"},
+			},
+			origin: "https://evil.test",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCORS(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			// The headers of the upstream are replaced
+			resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, "https://upstream.test")
+			resp.Header.Set(fasthttp.HeaderAccessControlAllowCredentials, "true")
+			resp.Header.Set(fasthttp.HeaderAccessControlExposeHeaders, "X-Upstream")
+
+			c.response(tt.origin, resp)
+			for k, v := range tt.want {
+				if got := string(resp.Header.Peek(k)); got != v {
+					t.Errorf("response() %s = %q, want %q", k, got, v)
+				}
+			}
+			if got := string(resp.Header.Peek(fasthttp.HeaderVary)) == fasthttp.HeaderOrigin; got != tt.wantVary {
+				t.Errorf("response() Vary: Origin = %v, want %v", got, tt.wantVary)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package easiest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// debugHandler serves the state of the server, the others fall back to http.DefaultServeMux for pprof.
+func (s *Server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metrics.serveMetrics)
+	mux.HandleFunc("/debug/ratelimit", s.debugRateLimit)
+	mux.HandleFunc("/debug/cache", s.debugCache)
+	mux.HandleFunc("/debug/cache/purge", s.debugCachePurge)
+	mux.Handle("/", http.DefaultServeMux)
+	return mux
+}
+
+type debugRateLimit struct {
+	Route  string             `json:"route"`
+	Rule   debugRateLimitRule `json:"rule"`
+	Tokens map[string]float64 `json:"tokens"`
+}
+
+type debugRateLimitRule struct {
+	Rate       float64 `json:"rate,omitempty"`
+	Burst      int     `json:"burst,omitempty"`
+	Key        string  `json:"key,omitempty"`
+	Header     string  `json:"header,omitempty"`
+	PathPrefix string  `json:"pathPrefix,omitempty"`
+}
+
+func (s *Server) debugRateLimit(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	limits := []debugRateLimit{}
+	for _, route := range s.routes() {
+		for _, l := range route.rateLimiters {
+			limits = append(limits, debugRateLimit{
+				Route:  route.name(),
+				Rule:   debugRateLimitRule(l.conf),
+				Tokens: l.snapshot(now),
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+type debugCache struct {
+	Route       string        `json:"route"`
+	Hits        int64         `json:"hits"`
+	Misses      int64         `json:"misses"`
+	Revalidated int64         `json:"revalidated"`
+	Stale       int64         `json:"stale"`
+	Entries     []*cacheEntry `json:"entries"`
+}
+
+// debugCache lists the cache entries of the routes, or only of the route in the query.
+func (s *Server) debugCache(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("route")
+	caches := []debugCache{}
+	for _, route := range s.routes() {
+		if route.cache == nil || (name != "" && route.name() != name) {
+			continue
+		}
+		caches = append(caches, debugCache{
+			Route:       route.name(),
+			Hits:        atomic.LoadInt64(&route.cache.hits),
+			Misses:      atomic.LoadInt64(&route.cache.misses),
+			Revalidated: atomic.LoadInt64(&route.cache.revalidated),
+			Stale:       atomic.LoadInt64(&route.cache.stale),
+			Entries:     route.cache.store.entries(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caches)
+}
+
+// debugCachePurge removes the cache entries by the url, the prefix or the route in the query.
+func (s *Server) debugCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("route")
+	var match func(key string) bool
+	switch {
+	case query.Get("url") != "":
+		key := cacheKeyOf(query.Get("url"))
+		match = func(k string) bool {
+			return k == key
+		}
+	case query.Get("prefix") != "":
+		prefix := cacheKeyOf(query.Get("prefix"))
+		match = func(k string) bool {
+			return strings.HasPrefix(k, prefix)
+		}
+	case name != "":
+		match = func(k string) bool {
+			return true
+		}
+	default:
+		http.Error(w, "url, prefix or route is required", http.StatusBadRequest)
+		return
+	}
+
+	purged := 0
+	for _, route := range s.routes() {
+		if route.cache == nil || (name != "" && route.name() != name) {
+			continue
+		}
+		purged += route.cache.purge(match)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"purged": purged,
+	})
+}
+
+// cacheKeyOf returns the cache key of the URL, the scheme is not part of the key.
+// The URL is parsed like the requests are, so its path is normalized the same way as the stored keys.
+func cacheKeyOf(rawURL string) string {
+	if !strings.Contains(rawURL, "://") {
+		return rawURL
+	}
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+	err := uri.Parse(nil, []byte(rawURL))
+	if err != nil {
+		return rawURL
+	}
+	return string(uri.Host()) + string(uri.RequestURI())
+}
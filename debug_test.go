@@ -0,0 +1,226 @@
+package easiest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newTestCacheServer returns a server with the cached routes a.test and b.test,
+// the paths are stored in the cache of a.test and the first one is hit once.
+func newTestCacheServer(t *testing.T, paths ...string) *Server {
+	s, err := NewServer(Config{
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: "http://127.0.0.1:1",
+				Cache:  &CacheConfig{},
+			},
+			{
+				Domain: "b.test",
+				Target: "http://127.0.0.1:1",
+				Cache:  &CacheConfig{},
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeUpstream{
+		header: map[string]string{
+			fasthttp.HeaderCacheControl: "max-age=60",
+		},
+		body: "body",
+	}
+	store := func(route *routeEntry, path string) {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+		req.SetRequestURI("http://" + route.Domain + path)
+		err := route.cache.do(requestCacheKey(req), req, resp, upstream.fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range paths {
+		store(s.route["a.test"], path)
+	}
+	store(s.route["a.test"], paths[0])
+	store(s.route["b.test"], "/b")
+	return s
+}
+
+func Test_Server_debugCache(t *testing.T) {
+	s := newTestCacheServer(t, "/a", "/static/1")
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]debugCache
+	}{
+		{
+			name: "all",
+			want: map[string]debugCache{
+				"a.test": {Hits: 1, Misses: 2},
+				"b.test": {Misses: 1},
+			},
+		},
+		{
+			name:  "route",
+			query: "?route=b.test",
+			want: map[string]debugCache{
+				"b.test": {Misses: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.debugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/cache"+tt.query, nil))
+			var caches []debugCache
+			err := json.NewDecoder(w.Body).Decode(&caches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(caches) != len(tt.want) {
+				t.Fatalf("routes = %d, want %d", len(caches), len(tt.want))
+			}
+			for _, got := range caches {
+				want, ok := tt.want[got.Route]
+				if !ok {
+					t.Fatalf("unexpected route %q", got.Route)
+				}
+				if got.Hits != want.Hits || got.Misses != want.Misses {
+					t.Errorf("%s hits, misses = %d, %d, want %d, %d", got.Route, got.Hits, got.Misses, want.Hits, want.Misses)
+				}
+				if len(got.Entries) != int(want.Misses) {
+					t.Errorf("%s entries = %d, want %d", got.Route, len(got.Entries), want.Misses)
+				}
+			}
+		})
+	}
+}
+
+func Test_Server_debugCachePurge(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+		wantPurged int
+		wantKept   []string
+	}{
+		{
+			name:       "url",
+			method:     http.MethodPost,
+			query:      "?url=https://a.test/a",
+			wantStatus: http.StatusOK,
+			wantPurged: 1,
+			wantKept:   []string{"a.test/static/1", "a.test/static/2", "b.test/b"},
+		},
+		{
+			name:       "prefix",
+			method:     http.MethodDelete,
+			query:      "?prefix=a.test/static/",
+			wantStatus: http.StatusOK,
+			wantPurged: 2,
+			wantKept:   []string{"a.test/a", "b.test/b"},
+		},
+		{
+			name:       "prefix of a route",
+			method:     http.MethodPost,
+			query:      "?prefix=http://a.test/&route=b.test",
+			wantStatus: http.StatusOK,
+			wantPurged: 0,
+			wantKept:   []string{"a.test/a", "a.test/static/1", "a.test/static/2", "b.test/b"},
+		},
+		{
+			name:       "route",
+			method:     http.MethodPost,
+			query:      "?route=a.test",
+			wantStatus: http.StatusOK,
+			wantPurged: 3,
+			wantKept:   []string{"b.test/b"},
+		},
+		{
+			name:       "no selector",
+			method:     http.MethodPost,
+			wantStatus: http.StatusBadRequest,
+			wantKept:   []string{"a.test/a", "a.test/static/1", "a.test/static/2", "b.test/b"},
+		},
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			query:      "?route=a.test",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantKept:   []string{"a.test/a", "a.test/static/1", "a.test/static/2", "b.test/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestCacheServer(t, "/a", "/static/1", "/static/2")
+			w := httptest.NewRecorder()
+			s.debugHandler().ServeHTTP(w, httptest.NewRequest(tt.method, "/debug/cache/purge"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusOK {
+				var got map[string]int
+				err := json.NewDecoder(w.Body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got["purged"] != tt.wantPurged {
+					t.Errorf("purged = %d, want %d", got["purged"], tt.wantPurged)
+				}
+			}
+
+			kept := map[string]bool{}
+			for _, route := range s.routes() {
+				for _, entry := range route.cache.store.entries() {
+					kept[entry.Key] = true
+				}
+			}
+			if len(kept) != len(tt.wantKept) {
+				t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+			}
+			for _, key := range tt.wantKept {
+				if !kept[key] {
+					t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+					break
+				}
+			}
+		})
+	}
+}
+
+func Test_cacheKeyOf(t *testing.T) {
+	tests := []string{
+		"/a",
+		"/a%41b",
+		"/a%2Fb",
+		"/caf%C3%A9?q=%20x",
+		"/x/../y?b=1&a=2",
+		"/%7Euser/",
+	}
+	for _, requestURI := range tests {
+		t.Run(requestURI, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			raw := "GET " + requestURI + " HTTP/1.1\r\nHost: a.test\r\n\r\n"
+			err := req.Read(bufio.NewReader(strings.NewReader(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := requestCacheKey(req)
+			if got := cacheKeyOf("http://a.test" + requestURI); got != want {
+				t.Errorf("cacheKeyOf() = %q, want the stored key %q", got, want)
+			}
+		})
+	}
+}
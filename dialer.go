@@ -0,0 +1,204 @@
+package easiest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// newUpstreamDial returns the dial function of the route upstream,
+// without a proxy configured the proxy is taken from the environment.
+// The timeout bounds the whole dial through the proxy, not only the connection to it.
+func newUpstreamDial(conf Route, forward proxy.Dialer, timeout time.Duration) (fasthttp.DialFunc, error) {
+	if conf.Proxy == "" {
+		return newEnvironmentProxyDial(forward, timeout), nil
+	}
+
+	dialer, err := newProxyDialer(conf.Proxy, forward)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.NoProxy) != 0 {
+		perHost := proxy.NewPerHost(dialer, forward)
+		perHost.AddFromString(strings.Join(conf.NoProxy, ","))
+		dialer = perHost
+	}
+	dialer = withDialTimeout(dialer, timeout)
+	return func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}, nil
+}
+
+// newUnixDial returns the dial function to the unix socket, the address is ignored.
+func newUnixDial(path string, timeout time.Duration) fasthttp.DialFunc {
+	return func(string) (net.Conn, error) {
+		return net.DialTimeout("unix", path, timeout)
+	}
+}
+
+// newEnvironmentProxyDial returns the dial function with the proxy
+// from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func newEnvironmentProxyDial(forward proxy.Dialer, timeout time.Duration) fasthttp.DialFunc {
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+	return func(addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		u := &url.URL{
+			Scheme: "http",
+			Host:   addr,
+		}
+		if port == "443" {
+			u.Scheme = "https"
+		}
+		proxyURL, err := proxyFunc(u)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return forward.Dial("tcp", addr)
+		}
+		dialer, err := newProxyDialer(proxyURL.String(), forward)
+		if err != nil {
+			return nil, err
+		}
+		return withDialTimeout(dialer, timeout).Dial("tcp", addr)
+	}
+}
+
+func newProxyDialer(rawURL string, forward proxy.Dialer) (proxy.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpConnectDialer{
+			proxy:   u,
+			forward: forward,
+		}, nil
+	case "socks5", "socks5h":
+		return proxy.FromURL(u, forward)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// httpConnectDialer dials through an HTTP proxy with the CONNECT method.
+type httpConnectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials through the proxy, the context also bounds the TLS handshake
+// with the proxy and the read of its response.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		port := "80"
+		if d.proxy.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(d.proxy.Hostname(), port)
+	}
+
+	var raw net.Conn
+	var err error
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		raw, err = cd.DialContext(ctx, network, proxyAddr)
+	} else {
+		raw, err = d.forward.Dial(network, proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Interrupts the pending handshake or read
+			raw.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	conn, err := d.connect(raw, addr)
+	close(stop)
+	<-stopped
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		conn.Close()
+		return nil, ctxErr
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect sends the CONNECT to the proxy and reads its response,
+// the conn is closed on failure.
+func (d *httpConnectDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	if d.proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{
+			ServerName: d.proxy.Hostname(),
+		})
+	}
+
+	var data = "CONNECT " + addr + " HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n"
+	if user := d.proxy.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		data += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	data += "\r\n"
+
+	_, err := conn.Write([]byte(data))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect %q: %s", addr, resp.Status)
+	}
+
+	buffered, _ := reader.Peek(reader.Buffered())
+	return wrapUnreadConn(conn, append([]byte(nil), buffered...)), nil
+}
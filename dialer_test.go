@@ -0,0 +1,400 @@
+package easiest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startEcho starts an upstream echoing the bytes on the address and returns the address it listens on.
+func startEcho(t *testing.T, network, addr string) string {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startConnectProxy starts an HTTP proxy with the CONNECT method,
+// it requires the Proxy-Authorization if auth is not empty.
+func startConnectProxy(t *testing.T, auth string, used *int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				atomic.AddInt32(used, 1)
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startSOCKS5Proxy starts a SOCKS5 proxy with the username and password authentication.
+func startSOCKS5Proxy(t *testing.T, user, password string, used *int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				atomic.AddInt32(used, 1)
+				upstream, err := socks5Handshake(conn, user, password)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func socks5Handshake(conn net.Conn, user, password string) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return nil, err
+	}
+	// Username and password, RFC 1929
+	conn.Write([]byte{5, 2})
+	if _, err := io.ReadFull(reader, head[:2]); err != nil {
+		return nil, err
+	}
+	gotUser := make([]byte, head[1])
+	io.ReadFull(reader, gotUser)
+	n, _ := reader.ReadByte()
+	gotPassword := make([]byte, n)
+	io.ReadFull(reader, gotPassword)
+	if string(gotUser) != user || string(gotPassword) != password {
+		conn.Write([]byte{1, 1})
+		return nil, io.EOF
+	}
+	conn.Write([]byte{1, 0})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return nil, err
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := reader.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		return nil, io.EOF
+	}
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return upstream, nil
+}
+
+// echoThrough dials the echo through the dial function and checks a round trip.
+func echoThrough(dial func(addr string) (net.Conn, error), addr string) error {
+	conn, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf) != "ping" {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func Test_newUpstreamDial_proxy(t *testing.T) {
+	echo := startEcho(t, "tcp", "127.0.0.1:0")
+	var connectUsed, socksUsed int32
+	connectProxy := startConnectProxy(t, "user:pass", &connectUsed)
+	socksProxy := startSOCKS5Proxy(t, "user", "pass", &socksUsed)
+	tests := []struct {
+		name     string
+		route    Route
+		used     *int32
+		wantUsed bool
+		wantErr  bool
+	}{
+		{
+			name:     "http connect",
+			route:    Route{Proxy: "http://user:pass@" + connectProxy},
+			used:     &connectUsed,
+			wantUsed: true,
+		},
+		{
+			name:     "http connect wrong auth",
+			route:    Route{Proxy: "http://user:wrong@" + connectProxy},
+			used:     &connectUsed,
+			wantUsed: true,
+			wantErr:  true,
+		},
+		{
+			name:     "socks5",
+			route:    Route{Proxy: "socks5://user:pass@" + socksProxy},
+			used:     &socksUsed,
+			wantUsed: true,
+		},
+		{
+			name:     "socks5 wrong auth",
+			route:    Route{Proxy: "socks5://user:wrong@" + socksProxy},
+			used:     &socksUsed,
+			wantUsed: true,
+			wantErr:  true,
+		},
+		{
+			name:  "no proxy",
+			route: Route{Proxy: "http://user:pass@" + connectProxy, NoProxy: []string{"127.0.0.1"}},
+			used:  &connectUsed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, err := newUpstreamDial(tt.route, &net.Dialer{}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := atomic.LoadInt32(tt.used)
+			err = echoThrough(dial, echo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if used := atomic.LoadInt32(tt.used) != before; used != tt.wantUsed {
+				t.Errorf("proxy used = %v, want %v", used, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func Test_newUpstreamDial_stalledProxy(t *testing.T) {
+	// The proxy accepts the connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	for _, scheme := range []string{"http", "https", "socks5"} {
+		t.Run(scheme, func(t *testing.T) {
+			dial, err := newUpstreamDial(Route{Proxy: scheme + "://" + listener.Addr().String()}, &net.Dialer{}, 100*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				conn, err := dial("127.0.0.1:1")
+				if err == nil {
+					conn.Close()
+				}
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("dial through the stalled proxy succeeded")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("dial through the stalled proxy is not timed out")
+			}
+		})
+	}
+}
+
+func Test_newUpstreamDial_unsupported(t *testing.T) {
+	_, err := newUpstreamDial(Route{Proxy: "ftp://127.0.0.1:21"}, &net.Dialer{}, 0)
+	if err == nil {
+		t.Error("newUpstreamDial() = nil error, want unsupported scheme")
+	}
+}
+
+// startUnixHTTP starts an upstream on a unix socket responding with the Host header.
+func startUnixHTTP(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host)
+		}),
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+func Test_unixTarget_http(t *testing.T) {
+	path := startUnixHTTP(t)
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{
+			name:  "default",
+			route: Route{Target: "http+unix://" + path},
+			want:  "localhost",
+		},
+		{
+			name:  "unix",
+			route: Route{Target: "unix://" + path},
+			want:  "localhost",
+		},
+		{
+			name:  "upstream host",
+			route: Route{Target: "http+unix://" + path, UpstreamHost: "b.test"},
+			want:  "b.test",
+		},
+		{
+			name:  "preserve host",
+			route: Route{Target: "http+unix://" + path, PreserveHost: true},
+			want:  "a.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.route.Domain = "a.test"
+			addr := bindTestRoute(t, Config{Routes: []Route{tt.route}}, "a.test")
+			if got := getThrough(t, addr, "a.test"); got != tt.want {
+				t.Errorf("upstream Host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_unixTarget_stream(t *testing.T) {
+	path := startEcho(t, "unix", filepath.Join(t.TempDir(), "echo.sock"))
+	addr := bindTestRoute(t, Config{
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: "unix://" + path,
+				Stream: true,
+			},
+		},
+	}, "a.test")
+
+	err := echoThrough(func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_newRouteEntry_tcpTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{
+			name:  "stream",
+			route: Route{Domain: "a.test", Target: "tcp://127.0.0.1:22", Stream: true},
+		},
+		{
+			name:  "listen",
+			route: Route{Listen: ":2222", Target: "tcp://127.0.0.1:22"},
+		},
+		{
+			name:    "http",
+			route:   Route{Domain: "a.test", Target: "tcp://127.0.0.1:22"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouteEntry(tt.route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRouteEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
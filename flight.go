@@ -0,0 +1,42 @@
+package easiest
+
+import (
+	"sync"
+)
+
+// flightGroup collapses the concurrent fetches of the same key.
+type flightGroup struct {
+	mut   sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// start returns the call in flight of the key,
+// leader is true if the call is new and the caller must finish it.
+func (g *flightGroup) start(key string) (call *flightCall, leader bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	call = &flightCall{
+		done: make(chan struct{}),
+	}
+	g.calls[key] = call
+	return call, true
+}
+
+func (g *flightGroup) finish(key string, call *flightCall, err error) {
+	g.mut.Lock()
+	delete(g.calls, key)
+	g.mut.Unlock()
+	call.err = err
+	close(call.done)
+}
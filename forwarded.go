@@ -0,0 +1,118 @@
+package easiest
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	headerXForwardedPort = "X-Forwarded-Port"
+	headerXRealIP        = "X-Real-IP"
+)
+
+// clientIP returns the IP of the client,
+// the X-Forwarded-For is followed from the right as long as the hops are trusted proxies.
+func (s *Server) clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	ip := ctx.RemoteIP()
+	if !s.trustedProxies.Contains(ip) {
+		return ip
+	}
+	xff := string(ctx.Request.Header.Peek(fasthttp.HeaderXForwardedFor))
+	if xff == "" {
+		return ip
+	}
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !s.trustedProxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardingHeaders is all the forwarding headers a client may send.
+var forwardingHeaders = []string{
+	headerXRealIP,
+	fasthttp.HeaderXForwardedFor,
+	fasthttp.HeaderXForwardedProto,
+	fasthttp.HeaderXForwardedHost,
+	headerXForwardedPort,
+	fasthttp.HeaderForwarded,
+}
+
+// forwardHeaders sets the forwarding headers of the request,
+// incoming values are kept only when the peer is a trusted proxy,
+// or else all of them are removed, even the ones the route doesn't set.
+func (s *Server) forwardHeaders(ctx *fasthttp.RequestCtx, conf HttpConfig, host string) {
+	req := &ctx.Request
+	remote := ctx.RemoteIP()
+	trusted := s.trustedProxies.Contains(remote)
+	if !trusted {
+		for _, key := range forwardingHeaders {
+			req.Header.Del(key)
+		}
+	}
+
+	proto := "http"
+	if ctx.IsTLS() {
+		proto = "https"
+	}
+
+	if conf.HeaderRealIP {
+		setForwardedHeader(req, headerXRealIP, s.clientIP(ctx).String(), trusted)
+	}
+	if conf.HeaderForwardedFor {
+		appendForwardedHeader(req, fasthttp.HeaderXForwardedFor, remote.String(), trusted)
+	}
+	if conf.HeaderForwardedProto {
+		setForwardedHeader(req, fasthttp.HeaderXForwardedProto, proto, trusted)
+	}
+	if conf.HeaderForwardedHost {
+		setForwardedHeader(req, fasthttp.HeaderXForwardedHost, host, trusted)
+	}
+	if conf.HeaderForwardedPort {
+		port := ""
+		if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+			port = strconv.Itoa(addr.Port)
+		}
+		setForwardedHeader(req, headerXForwardedPort, port, trusted)
+	}
+	if conf.HeaderForwarded {
+		elem := "for=" + forwardedNode(remote) +
+			";host=" + strconv.Quote(host) +
+			";proto=" + proto
+		appendForwardedHeader(req, fasthttp.HeaderForwarded, elem, trusted)
+	}
+}
+
+func setForwardedHeader(req *fasthttp.Request, key, value string, trusted bool) {
+	if trusted && len(req.Header.Peek(key)) != 0 {
+		return
+	}
+	req.Header.Set(key, value)
+}
+
+func appendForwardedHeader(req *fasthttp.Request, key, value string, trusted bool) {
+	if trusted {
+		if prior := string(req.Header.Peek(key)); prior != "" {
+			value = prior + ", " + value
+		}
+	}
+	req.Header.Set(key, value)
+}
+
+// forwardedNode formats the IP as a node of the Forwarded header, RFC 7239 section 6.
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
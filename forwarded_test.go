@@ -0,0 +1,193 @@
+package easiest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// newTestRequestCtx returns the context of a request from the remote ip with the headers.
+func newTestRequestCtx(remote string, header map[string]string) *fasthttp.RequestCtx {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.SetRequestURI("http://a.test/")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(remote), Port: 12345}, nil)
+	return ctx
+}
+
+func Test_Server_clientIP(t *testing.T) {
+	trustedProxies, err := parseIPNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: trustedProxies}
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		want   string
+	}{
+		{
+			name:   "untrusted peer",
+			remote: "203.0.113.1",
+			xff:    "198.51.100.1",
+			want:   "203.0.113.1",
+		},
+		{
+			name:   "trusted peer",
+			remote: "10.0.0.1",
+			xff:    "198.51.100.1",
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "trusted peer without header",
+			remote: "10.0.0.1",
+			want:   "10.0.0.1",
+		},
+		{
+			name:   "trusted hops",
+			remote: "10.0.0.1",
+			xff:    "198.51.100.1, 10.0.0.3, 10.0.0.2",
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "spoofed before the untrusted hop",
+			remote: "10.0.0.1",
+			xff:    "192.0.2.1, 198.51.100.1, 10.0.0.2",
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "invalid hop",
+			remote: "10.0.0.1",
+			xff:    "198.51.100.1, garbage, 10.0.0.2",
+			want:   "10.0.0.2",
+		},
+		{
+			name:   "ipv6",
+			remote: "10.0.0.1",
+			xff:    "2001:db8::1",
+			want:   "2001:db8::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{}
+			if tt.xff != "" {
+				header[fasthttp.HeaderXForwardedFor] = tt.xff
+			}
+			ctx := newTestRequestCtx(tt.remote, header)
+			if got := s.clientIP(ctx).String(); got != tt.want {
+				t.Errorf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Server_forwardHeaders(t *testing.T) {
+	trustedProxies, err := parseIPNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: trustedProxies}
+	incoming := map[string]string{
+		"X-Real-IP":         "192.0.2.1",
+		"X-Forwarded-For":   "192.0.2.1",
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "evil.test",
+		"X-Forwarded-Port":  "8443",
+		"Forwarded":         "for=192.0.2.1",
+	}
+	all := HttpConfig{
+		HeaderForwardedFor:   true,
+		HeaderForwardedProto: true,
+		HeaderForwardedHost:  true,
+		HeaderForwardedPort:  true,
+		HeaderForwarded:      true,
+		HeaderRealIP:         true,
+	}
+	tests := []struct {
+		name   string
+		remote string
+		header map[string]string
+		conf   HttpConfig
+		want   map[string]string
+	}{
+		{
+			name:   "untrusted",
+			remote: "203.0.113.1",
+			header: incoming,
+			conf:   all,
+			want: map[string]string{
+				"X-Real-IP":         "203.0.113.1",
+				"X-Forwarded-For":   "203.0.113.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "a.test",
+				"X-Forwarded-Port":  "0",
+				"Forwarded":         `for=203.0.113.1;host="a.test";proto=http`,
+			},
+		},
+		{
+			name:   "untrusted with only forwarded for",
+			remote: "203.0.113.1",
+			header: incoming,
+			conf:   HttpConfig{HeaderForwardedFor: true},
+			want: map[string]string{
+				"X-Real-IP":         "",
+				"X-Forwarded-For":   "203.0.113.1",
+				"X-Forwarded-Proto": "",
+				"X-Forwarded-Host":  "",
+				"X-Forwarded-Port":  "",
+				"Forwarded":         "",
+			},
+		},
+		{
+			name:   "trusted",
+			remote: "10.0.0.1",
+			header: incoming,
+			conf:   all,
+			want: map[string]string{
+				"X-Real-IP":         "192.0.2.1",
+				"X-Forwarded-For":   "192.0.2.1, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.test",
+				"X-Forwarded-Port":  "8443",
+				"Forwarded":         `for=192.0.2.1, for=10.0.0.1;host="a.test";proto=http`,
+			},
+		},
+		{
+			name:   "trusted without headers",
+			remote: "10.0.0.1",
+			conf:   all,
+			want: map[string]string{
+				"X-Real-IP":       "10.0.0.1",
+				"X-Forwarded-For": "10.0.0.1",
+			},
+		},
+		{
+			name:   "ipv6",
+			remote: "2001:db8::1",
+			conf:   all,
+			want: map[string]string{
+				"X-Real-IP":       "2001:db8::1",
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host="a.test";proto=http`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestRequestCtx(tt.remote, tt.header)
+			s.forwardHeaders(ctx, tt.conf, "a.test")
+			for k, v := range tt.want {
+				if got := string(ctx.Request.Header.Peek(k)); got != v {
+					t.Errorf("forwardHeaders() %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/valyala/fasthttp v1.41.0
 	github.com/wzshiming/sni v0.0.3
 	golang.org/x/crypto v0.1.0
+	golang.org/x/net v0.7.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -13,6 +14,5 @@ require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 )
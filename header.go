@@ -0,0 +1,86 @@
+package easiest
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// header is the common part of fasthttp.RequestHeader and fasthttp.ResponseHeader.
+type header interface {
+	Peek(key string) []byte
+	Set(key, value string)
+	SetBytesV(key string, value []byte)
+	Add(key, value string)
+	Del(key string)
+}
+
+// rewriteHeaders replaces old with new in the values of the listed headers.
+func rewriteHeaders(h header, keys []string, replaces []Replace, reverse bool) {
+	for _, key := range keys {
+		value := h.Peek(key)
+		if len(value) == 0 {
+			continue
+		}
+		h.SetBytesV(key, replaceBytes(value, replaces, reverse))
+	}
+}
+
+// applyHeaderPolicy applies the policy to the header,
+// the headers are rewritten first, then removed, set and added.
+func applyHeaderPolicy(h header, policy HeaderPolicy, replaces []Replace, reverse bool) {
+	rewriteHeaders(h, policy.Rewrite, replaces, reverse)
+	applyHeaderChanges(h, policy)
+}
+
+// applyHeaderChanges removes, sets and adds the headers of the policy.
+func applyHeaderChanges(h header, policy HeaderPolicy) {
+	for _, key := range policy.Remove {
+		h.Del(key)
+	}
+	for key, value := range policy.Set {
+		h.Set(key, value)
+	}
+	for key, values := range policy.Add {
+		for _, value := range values {
+			h.Add(key, value)
+		}
+	}
+}
+
+// applyDefaultResponseHeaders is the preset applied to every response
+// unless the route disables it, the headers in keep are not removed
+// so the ones rewritten by the route are sent.
+func applyDefaultResponseHeaders(req *fasthttp.Request, resp *fasthttp.Response, keep []string) {
+	if len(req.Header.Referer()) != 0 {
+		resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, "*")
+	}
+
+	for _, key := range []string{fasthttp.HeaderAltSvc, fasthttp.HeaderContentSecurityPolicy} {
+		if !containsFold(keep, key) {
+			resp.Header.Del(key)
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceBytes replaces all old with new in b, or new with old if reverse.
+func replaceBytes(b []byte, replaces []Replace, reverse bool) []byte {
+	for _, replace := range replaces {
+		if reverse {
+			b = bytes.Replace(b, []byte(replace.New), []byte(replace.Old), -1)
+		} else {
+			b = bytes.Replace(b, []byte(replace.Old), []byte(replace.New), -1)
+		}
+	}
+	return b
+}
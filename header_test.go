@@ -0,0 +1,136 @@
+package easiest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_applyHeaderPolicy(t *testing.T) {
+	replaces := []Replace{
+		{
+			Old: "upstream.com",
+			New: "mirror.com",
+		},
+	}
+	tests := []struct {
+		name   string
+		header map[string]string
+		policy HeaderPolicy
+		want   map[string]string
+	}{
+		{
+			name: "remove",
+			header: map[string]string{
+				"Alt-Svc": "h3=\":443\"",
+			},
+			policy: HeaderPolicy{
+				Remove: []string{"Alt-Svc"},
+			},
+			want: map[string]string{
+				"Alt-Svc": "",
+			},
+		},
+		{
+			name: "rewrite",
+			header: map[string]string{
+				"Content-Security-Policy": "default-src https://upstream.com",
+			},
+			policy: HeaderPolicy{
+				Rewrite: []string{"Content-Security-Policy"},
+			},
+			want: map[string]string{
+				"Content-Security-Policy": "default-src https://mirror.com",
+			},
+		},
+		{
+			name: "set",
+			header: map[string]string{
+				"X-Frame-Options": "DENY",
+			},
+			policy: HeaderPolicy{
+				Set: map[string]string{
+					"X-Frame-Options": "SAMEORIGIN",
+				},
+			},
+			want: map[string]string{
+				"X-Frame-Options": "SAMEORIGIN",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			for k, v := range tt.header {
+				resp.Header.Set(k, v)
+			}
+			applyHeaderPolicy(&resp.Header, tt.policy, replaces, false)
+			for k, v := range tt.want {
+				if got := string(resp.Header.Peek(k)); got != v {
+					t.Errorf("applyHeaderPolicy() %s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func Test_applyHeaderPolicy_add(t *testing.T) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+	resp.Header.Set("Link", "</a.css>; rel=preload")
+	applyHeaderPolicy(&resp.Header, HeaderPolicy{
+		Add: map[string][]string{
+			"Link": {"</b.css>; rel=preload", "</c.js>; rel=preload"},
+		},
+	}, nil, false)
+
+	var got []string
+	resp.Header.VisitAll(func(key, value []byte) {
+		if string(key) == "Link" {
+			got = append(got, string(value))
+		}
+	})
+	want := []string{"</a.css>; rel=preload", "</b.css>; rel=preload", "</c.js>; rel=preload"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("applyHeaderPolicy() Link = %q, want %q", got, want)
+	}
+}
+
+func Test_applyDefaultResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		keep []string
+		want string
+	}{
+		{
+			name: "removed",
+			want: "",
+		},
+		{
+			name: "rewritten",
+			keep: []string{"content-security-policy"},
+			want: "default-src https://mirror.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+			resp.Header.Set("Content-Security-Policy", "default-src https://upstream.com")
+			resp.Header.Set("Alt-Svc", "h3=\":443\"")
+
+			rewriteHeaders(&resp.Header, tt.keep, []Replace{{Old: "upstream.com", New: "mirror.com"}}, false)
+			applyDefaultResponseHeaders(req, resp, tt.keep)
+			if got := string(resp.Header.Peek("Content-Security-Policy")); got != tt.want {
+				t.Errorf("Content-Security-Policy = %q, want %q", got, tt.want)
+			}
+			if got := resp.Header.Peek("Alt-Svc"); len(got) != 0 {
+				t.Errorf("Alt-Svc = %q, want removed", got)
+			}
+		})
+	}
+}
@@ -20,6 +20,16 @@ func connHTTPRedirect(conn net.Conn, url string, code int) error {
 	return err
 }
 
+func connHTTPError(conn net.Conn, code int) error {
+	var data = "HTTP/1.1 " + strconv.FormatInt(int64(code), 10) + " " + http.StatusText(code) + "\r\n" +
+		"Content-Length: 0\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
+
+	_, err := conn.Write([]byte(data))
+	return err
+}
+
 func connGetHTTPHost(conn net.Conn) (net.Conn, string, error) {
 	buf := bytes.NewBuffer(nil)
 	host, err := getHTTPHeader(io.TeeReader(conn, buf), []byte("host"))
@@ -0,0 +1,222 @@
+package easiest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	errConnLimit     = errors.New("too many connections")
+	errUpstreamLimit = errors.New("too many upstream connections")
+)
+
+// semaphore limits the concurrency, a nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits up to the timeout for a slot, a zero timeout does not wait.
+func (s semaphore) acquire(timeout time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s == nil {
+		return
+	}
+	<-s
+}
+
+// keyedSemaphore is a semaphore for each key, a nil keyedSemaphore is unlimited.
+type keyedSemaphore struct {
+	max  int
+	mut  sync.Mutex
+	sems map[string]*keyedSemaphoreEntry
+}
+
+type keyedSemaphoreEntry struct {
+	sem  semaphore
+	refs int
+}
+
+func newKeyedSemaphore(n int) *keyedSemaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &keyedSemaphore{
+		max:  n,
+		sems: map[string]*keyedSemaphoreEntry{},
+	}
+}
+
+func (k *keyedSemaphore) acquire(key string, timeout time.Duration) bool {
+	if k == nil {
+		return true
+	}
+	k.mut.Lock()
+	entry, ok := k.sems[key]
+	if !ok {
+		entry = &keyedSemaphoreEntry{
+			sem: newSemaphore(k.max),
+		}
+		k.sems[key] = entry
+	}
+	entry.refs++
+	k.mut.Unlock()
+
+	if entry.sem.acquire(timeout) {
+		return true
+	}
+	k.unref(key, entry)
+	return false
+}
+
+func (k *keyedSemaphore) release(key string) {
+	if k == nil {
+		return
+	}
+	k.mut.Lock()
+	entry, ok := k.sems[key]
+	k.mut.Unlock()
+	if !ok {
+		return
+	}
+	entry.sem.release()
+	k.unref(key, entry)
+}
+
+func (k *keyedSemaphore) unref(key string, entry *keyedSemaphoreEntry) {
+	k.mut.Lock()
+	defer k.mut.Unlock()
+	entry.refs--
+	if entry.refs == 0 {
+		delete(k.sems, key)
+	}
+}
+
+// connLimits is the limits of the concurrent connections.
+// A connection over the limits is reset with a TCP RST, as nothing is read from it yet
+// and a TLS connection can't be answered before its handshake,
+// only a plain HTTP connection over the limits of its route is answered with a 503.
+type connLimits struct {
+	conns        semaphore
+	connsPerIP   *keyedSemaphore
+	queueTimeout time.Duration
+}
+
+func newConnLimits(conf LimitConfig) *connLimits {
+	return &connLimits{
+		conns:        newSemaphore(conf.MaxConns),
+		connsPerIP:   newKeyedSemaphore(conf.MaxConnsPerIP),
+		queueTimeout: conf.QueueTimeout,
+	}
+}
+
+// acquire takes a slot of the connection from the ip,
+// the release must be called when it's ok.
+// The slot of the ip is taken first, so an ip waiting at its limit holds no slot of the others,
+// and both waits share the queue timeout.
+func (l *connLimits) acquire(ip net.IP) (release func(), ok bool) {
+	return l.acquireWithin(ip, l.queueTimeout)
+}
+
+// tryAcquire takes a slot of the connection from the ip without waiting.
+func (l *connLimits) tryAcquire(ip net.IP) (release func(), ok bool) {
+	return l.acquireWithin(ip, 0)
+}
+
+func (l *connLimits) acquireWithin(ip net.IP, timeout time.Duration) (release func(), ok bool) {
+	deadline := time.Now().Add(timeout)
+	key := ip.String()
+	if !l.connsPerIP.acquire(key, timeout) {
+		return nil, false
+	}
+	if !l.conns.acquire(time.Until(deadline)) {
+		l.connsPerIP.release(key)
+		return nil, false
+	}
+	return func() {
+		l.conns.release()
+		l.connsPerIP.release(key)
+	}, true
+}
+
+// full reports whether a connection would be rejected without waiting,
+// to reject it before a goroutine is started for it.
+func (l *connLimits) full() bool {
+	return l.queueTimeout <= 0 && l.conns != nil && len(l.conns) == cap(l.conns)
+}
+
+// withUpstreamLimit returns the dial function that limits the concurrent connections of each address.
+func withUpstreamLimit(dial fasthttp.DialFunc, limit *keyedSemaphore, timeout time.Duration) fasthttp.DialFunc {
+	if limit == nil {
+		return dial
+	}
+	return func(addr string) (net.Conn, error) {
+		if !limit.acquire(addr, timeout) {
+			return nil, errUpstreamLimit
+		}
+		conn, err := dial(addr)
+		if err != nil {
+			limit.release(addr)
+			return nil, err
+		}
+		return &limitedConn{
+			Conn: conn,
+			release: func() {
+				limit.release(addr)
+			},
+		}, nil
+	}
+}
+
+// limitedConn releases its slot when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// resetConn closes the conn with a TCP RST if possible.
+func resetConn(conn net.Conn) error {
+	if l, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+		l.SetLinger(0)
+	}
+	return conn.Close()
+}
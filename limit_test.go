@@ -0,0 +1,129 @@
+package easiest
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_keyedSemaphore(t *testing.T) {
+	k := newKeyedSemaphore(1)
+	if !k.acquire("a", 0) {
+		t.Fatal("acquire a, want ok")
+	}
+	if k.acquire("a", 10*time.Millisecond) {
+		t.Fatal("acquire a again, want limited")
+	}
+	if !k.acquire("b", 0) {
+		t.Fatal("acquire b, want ok")
+	}
+	k.release("a")
+	if !k.acquire("a", 0) {
+		t.Fatal("acquire a after release, want ok")
+	}
+	k.release("a")
+	k.release("b")
+	if len(k.sems) != 0 {
+		t.Errorf("sems = %d, want 0", len(k.sems))
+	}
+}
+
+func Test_connLimits_acquire(t *testing.T) {
+	l := newConnLimits(LimitConfig{
+		MaxConns:      2,
+		MaxConnsPerIP: 1,
+		QueueTimeout:  100 * time.Millisecond,
+	})
+	a := net.ParseIP("10.0.0.1")
+	b := net.ParseIP("10.0.0.2")
+	c := net.ParseIP("10.0.0.3")
+
+	releaseA, ok := l.acquire(a)
+	if !ok {
+		t.Fatal("acquire a, want ok")
+	}
+	// a waits at its own limit without holding a slot of the others
+	waited := make(chan bool)
+	go func() {
+		_, ok := l.acquire(a)
+		waited <- ok
+	}()
+	time.Sleep(20 * time.Millisecond)
+	releaseB, ok := l.acquire(b)
+	if !ok {
+		t.Fatal("acquire b while a waits, want ok")
+	}
+	if <-waited {
+		t.Fatal("acquire a again, want limited")
+	}
+
+	if _, ok := l.acquire(c); ok {
+		t.Fatal("acquire c over the max, want limited")
+	}
+	releaseA()
+	releaseB()
+	if len(l.conns) != 0 || len(l.connsPerIP.sems) != 0 {
+		t.Errorf("slots = %d, %d, want released", len(l.conns), len(l.connsPerIP.sems))
+	}
+}
+
+func Test_connLimits_full(t *testing.T) {
+	l := newConnLimits(LimitConfig{
+		MaxConns: 1,
+	})
+	if l.full() {
+		t.Fatal("full before any connection")
+	}
+	release, ok := l.acquire(net.ParseIP("10.0.0.1"))
+	if !ok {
+		t.Fatal("acquire, want ok")
+	}
+	if !l.full() {
+		t.Fatal("not full at the max")
+	}
+	release()
+	if l.full() {
+		t.Fatal("full after release")
+	}
+}
+
+func Test_NewServer_maxUpstreamConns(t *testing.T) {
+	echo := startEcho(t, "tcp", "127.0.0.1:0")
+	s, err := NewServer(Config{
+		Limits: LimitConfig{
+			MaxUpstreamConns: 1,
+		},
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: "tcp://" + echo,
+				Stream: true,
+			},
+			{
+				Domain: "b.test",
+				Target: "tcp://" + echo,
+				Stream: true,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := s.route["a.test"].dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.route["b.test"].dial(echo)
+	if err != errUpstreamLimit {
+		t.Fatalf("dial over the limit error = %v, want %v", err, errUpstreamLimit)
+	}
+
+	// The slot is shared by the routes and released on close
+	conn.Close()
+	conn, err = s.route["b.test"].dial(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,385 @@
+package easiest
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultBuckets is the upper bounds of the latency histograms in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics is the state exposed in the Prometheus text format.
+type metrics struct {
+	requests        *intVec
+	requestDuration *histogramVec
+	activeConns     *intVec
+	tunnelBytes     *intVec
+	dialErrors      *intVec
+	handshakeErrors *intVec
+	acmeEvents      *intVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:        newIntVec("easiest_http_requests_total", "counter", "HTTP requests by route and status.", "route", "status"),
+		requestDuration: newHistogramVec("easiest_http_request_duration_seconds", "HTTP request latency by route.", defaultBuckets, "route"),
+		activeConns:     newIntVec("easiest_active_connections", "gauge", "Active connections by listener and route.", "listener", "route"),
+		tunnelBytes:     newIntVec("easiest_tunnel_bytes_total", "counter", "Bytes of the stream tunnels by route and direction.", "route", "direction"),
+		dialErrors:      newIntVec("easiest_upstream_dial_errors_total", "counter", "Upstream dial errors by route.", "route"),
+		handshakeErrors: newIntVec("easiest_tls_handshake_errors_total", "counter", "TLS handshake failures by reason.", "reason"),
+		acmeEvents:      newIntVec("easiest_acme_events_total", "counter", "ACME certificate events.", "event"),
+	}
+}
+
+// serveMetrics writes all the metrics.
+func (m *metrics) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.requests.writeTo(w)
+	m.requestDuration.writeTo(w)
+	m.activeConns.writeTo(w)
+	m.tunnelBytes.writeTo(w)
+	m.dialErrors.writeTo(w)
+	m.handshakeErrors.writeTo(w)
+	m.acmeEvents.writeTo(w)
+	writeBytesPoolMetrics(w)
+}
+
+// trackConn counts the connection as active until the returned func is called.
+func (m *metrics) trackConn(listener, route string) func() {
+	gauge := m.activeConns.with(listener, route)
+	atomic.AddInt64(gauge, 1)
+	return func() {
+		atomic.AddInt64(gauge, -1)
+	}
+}
+
+// withDialMetrics returns the dial function that counts the errors.
+func (m *metrics) withDialMetrics(dial fasthttp.DialFunc, route string) fasthttp.DialFunc {
+	if dial == nil {
+		return nil
+	}
+	counter := m.dialErrors.with(route)
+	return func(addr string) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			atomic.AddInt64(counter, 1)
+		}
+		return conn, err
+	}
+}
+
+// handshakeReason returns the reason label of the TLS handshake error.
+func handshakeReason(err error) string {
+	var netErr net.Error
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, errClientCertDenied):
+		return "client_cert_denied"
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalid):
+		return "client_cert_invalid"
+	case strings.Contains(err.Error(), "client didn't provide a certificate"):
+		return "client_cert_required"
+	case strings.Contains(err.Error(), "acme/autocert"):
+		return "certificate"
+	}
+	return "other"
+}
+
+// acmeMetricsCache counts the certificates stored by autocert,
+// a certificate missed before is issued, or else it's renewed.
+type acmeMetricsCache struct {
+	autocert.Cache
+	events *intVec
+	mut    sync.Mutex
+	missed map[string]bool
+}
+
+func (c *acmeMetricsCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.Cache.Get(ctx, key)
+	if err == autocert.ErrCacheMiss {
+		c.mut.Lock()
+		c.missed[key] = true
+		c.mut.Unlock()
+	}
+	return data, err
+}
+
+func (c *acmeMetricsCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	if strings.HasPrefix(key, "acme_account") || strings.HasSuffix(key, "+token") || strings.HasSuffix(key, "+http-01") {
+		return err
+	}
+	if err != nil {
+		atomic.AddInt64(c.events.with("store_error"), 1)
+		return err
+	}
+	c.mut.Lock()
+	missed := c.missed[key]
+	delete(c.missed, key)
+	c.mut.Unlock()
+	if missed {
+		atomic.AddInt64(c.events.with("issued"), 1)
+	} else {
+		atomic.AddInt64(c.events.with("renewed"), 1)
+	}
+	return nil
+}
+
+// countingConn counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+	// readTotal and writtenTotal are shared by the connections
+	readTotal    *int64
+	writtenTotal *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	if c.readTotal != nil {
+		atomic.AddInt64(c.readTotal, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	if c.writtenTotal != nil {
+		atomic.AddInt64(c.writtenTotal, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+var bytesPoolStats struct {
+	gets   int64
+	puts   int64
+	allocs int64
+}
+
+func getBytes() []byte {
+	atomic.AddInt64(&bytesPoolStats.gets, 1)
+	return bytesPool.Get().([]byte)
+}
+
+func putBytes(b []byte) {
+	atomic.AddInt64(&bytesPoolStats.puts, 1)
+	bytesPool.Put(b)
+}
+
+func writeBytesPoolMetrics(w io.Writer) {
+	gets := atomic.LoadInt64(&bytesPoolStats.gets)
+	puts := atomic.LoadInt64(&bytesPoolStats.puts)
+	writeMetricHeader(w, "easiest_bytes_pool_gets_total", "counter", "Buffers taken from the pool.")
+	fmt.Fprintf(w, "easiest_bytes_pool_gets_total %d\n", gets)
+	writeMetricHeader(w, "easiest_bytes_pool_allocs_total", "counter", "Buffers allocated by the pool.")
+	fmt.Fprintf(w, "easiest_bytes_pool_allocs_total %d\n", atomic.LoadInt64(&bytesPoolStats.allocs))
+	writeMetricHeader(w, "easiest_bytes_pool_in_use", "gauge", "Buffers taken and not returned to the pool.")
+	fmt.Fprintf(w, "easiest_bytes_pool_in_use %d\n", gets-puts)
+}
+
+// intVec is a counter or a gauge with labels.
+type intVec struct {
+	name   string
+	typ    string
+	help   string
+	labels []string
+	mut    sync.Mutex
+	values map[string]*labeledInt
+}
+
+type labeledInt struct {
+	labels []string
+	value  int64
+}
+
+func newIntVec(name, typ, help string, labels ...string) *intVec {
+	return &intVec{
+		name:   name,
+		typ:    typ,
+		help:   help,
+		labels: labels,
+		values: map[string]*labeledInt{},
+	}
+}
+
+// with returns the value of the labels to be updated atomically.
+func (v *intVec) with(labels ...string) *int64 {
+	key := strings.Join(labels, "\xff")
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	value, ok := v.values[key]
+	if !ok {
+		value = &labeledInt{
+			labels: labels,
+		}
+		v.values[key] = value
+	}
+	return &value.value
+}
+
+func (v *intVec) writeTo(w io.Writer) {
+	v.mut.Lock()
+	values := make([]*labeledInt, 0, len(v.values))
+	for _, value := range v.values {
+		values = append(values, value)
+	}
+	v.mut.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labels, "\xff") < strings.Join(values[j].labels, "\xff")
+	})
+
+	writeMetricHeader(w, v.name, v.typ, v.help)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, value.labels, "", ""), atomic.LoadInt64(&value.value))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mut     sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+func (v *histogramVec) observe(d time.Duration, labels ...string) {
+	seconds := d.Seconds()
+	key := strings.Join(labels, "\xff")
+	v.mut.Lock()
+	defer v.mut.Unlock()
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{
+			labels: labels,
+			counts: make([]uint64, len(v.buckets)),
+		}
+		v.values[key] = h
+	}
+	for i, bound := range v.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (v *histogramVec) writeTo(w io.Writer) {
+	// The histograms are copied so the observations don't wait for the writer
+	v.mut.Lock()
+	values := make([]*histogram, 0, len(v.values))
+	for _, h := range v.values {
+		values = append(values, &histogram{
+			labels: h.labels,
+			counts: append([]uint64(nil), h.counts...),
+			count:  h.count,
+			sum:    h.sum,
+		})
+	}
+	v.mut.Unlock()
+	sort.Slice(values, func(i, j int) bool {
+		return strings.Join(values[i].labels, "\xff") < strings.Join(values[j].labels, "\xff")
+	})
+
+	writeMetricHeader(w, v.name, "histogram", v.help)
+	for _, h := range values {
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, h.labels, "le", formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, h.labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, h.labels, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, h.labels, "", ""), h.count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// formatLabels formats the labels with an optional extra one.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
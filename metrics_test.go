@@ -0,0 +1,134 @@
+package easiest
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_metrics_writeTo(t *testing.T) {
+	requests := newIntVec("requests_total", "counter", "Requests.", "route", "status")
+	atomic.AddInt64(requests.with("b.com", "200"), 1)
+	atomic.AddInt64(requests.with("a.com", "200"), 2)
+	atomic.AddInt64(requests.with(`a"b`, "404"), 1)
+
+	duration := newHistogramVec("duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	duration.observe(50*time.Millisecond, "a.com")
+	duration.observe(500*time.Millisecond, "a.com")
+	duration.observe(5*time.Second, "a.com")
+
+	var b strings.Builder
+	requests.writeTo(&b)
+	duration.writeTo(&b)
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="a\"b",status="404"} 1
+requests_total{route="a.com",status="200"} 2
+requests_total{route="b.com",status="200"} 1
+# HELP duration_seconds Duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="a.com",le="0.1"} 1
+duration_seconds_bucket{route="a.com",le="1"} 2
+duration_seconds_bucket{route="a.com",le="+Inf"} 3
+duration_seconds_sum{route="a.com"} 5.55
+duration_seconds_count{route="a.com"} 3
+`
+	if got := b.String(); got != want {
+		t.Errorf("writeTo() = \n%s\nwant\n%s", got, want)
+	}
+}
+
+// blockingWriter blocks the writes until it's released.
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(b), nil
+}
+
+func Test_histogramVec_writeToBlocked(t *testing.T) {
+	duration := newHistogramVec("duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	duration.observe(50*time.Millisecond, "a.com")
+
+	w := &blockingWriter{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		duration.writeTo(w)
+		close(done)
+	}()
+	<-w.started
+
+	observed := make(chan struct{})
+	go func() {
+		duration.observe(50*time.Millisecond, "a.com")
+		close(observed)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(time.Second):
+		t.Error("observe is blocked by a stalled scrape")
+	}
+	close(w.release)
+	<-done
+}
+
+func Test_Server_handler_badGateway(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "http://" + closed.Addr().String()
+	closed.Close()
+
+	s, err := NewServer(Config{
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: target,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := bindTestServer(t, s, "a.test")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+
+	var b strings.Builder
+	s.metrics.requests.writeTo(&b)
+	if want := `easiest_http_requests_total{route="a.test",status="502"} 1`; !strings.Contains(b.String(), want) {
+		t.Errorf("requests = \n%s\nwant %s", b.String(), want)
+	}
+}
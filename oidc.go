@@ -0,0 +1,506 @@
+package easiest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	headerAuthRequestUser  = "X-Auth-Request-User"
+	headerAuthRequestEmail = "X-Auth-Request-Email"
+	headerAuthRequestName  = "X-Auth-Request-Preferred-Username"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcDiscoveryRetry is how long a failed discovery is answered before it's retried.
+const oidcDiscoveryRetry = 5 * time.Second
+
+var errInvalidIDToken = errors.New("invalid id token")
+
+// oidc is the login gate of a route with an OpenID Connect issuer.
+type oidc struct {
+	conf   OIDCConfig
+	key    []byte
+	client *http.Client
+
+	flight flightGroup
+
+	mut        sync.Mutex
+	provider   *oidcProvider
+	failure    error
+	retryAfter time.Time
+}
+
+// oidcProvider is the discovery document of the issuer.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// oidcSession is the identity kept in the session cookie.
+type oidcSession struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Expiry            int64  `json:"exp"`
+}
+
+// oidcState is kept in a cookie during the login.
+type oidcState struct {
+	State  string `json:"state"`
+	Nonce  string `json:"nonce"`
+	URL    string `json:"url"`
+	Expiry int64  `json:"exp"`
+}
+
+type oidcClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	Expiry            int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// audience is the aud claim, it's either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func newOIDC(conf OIDCConfig) (*oidc, error) {
+	if conf.Issuer == "" {
+		return nil, fmt.Errorf("issuer is required")
+	}
+	err := secureEndpoint(conf.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("issuer: %w", err)
+	}
+	if conf.ClientID == "" {
+		return nil, fmt.Errorf("client id is required")
+	}
+	if len(conf.CookieSecret) < 16 {
+		return nil, fmt.Errorf("cookie secret must be at least 16 bytes")
+	}
+	for _, pattern := range conf.AllowedEmails {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	if conf.RedirectPath == "" {
+		conf.RedirectPath = "/oauth2/callback"
+	}
+	if len(conf.Scopes) == 0 {
+		conf.Scopes = []string{"openid", "email", "profile"}
+	}
+	if conf.CookieName == "" {
+		conf.CookieName = "_easiest_session"
+	}
+	if conf.SessionTTL == 0 {
+		conf.SessionTTL = 24 * time.Hour
+	}
+	key := sha256.Sum256([]byte(conf.CookieSecret))
+	return &oidc{
+		conf: conf,
+		key:  key[:],
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// handle answers the requests of the login,
+// it returns false when the request has a session and can go to the upstream.
+func (o *oidc) handle(ctx *fasthttp.RequestCtx, host string) (bool, error) {
+	req := &ctx.Request
+	if string(req.URI().Path()) == o.conf.RedirectPath {
+		return true, o.callback(ctx, host)
+	}
+
+	var session oidcSession
+	if o.open("session", string(req.Header.Cookie(o.conf.CookieName)), &session, &session.Expiry) {
+		req.Header.Del(headerAuthRequestUser)
+		req.Header.Del(headerAuthRequestEmail)
+		req.Header.Del(headerAuthRequestName)
+		req.Header.Set(headerAuthRequestUser, session.Subject)
+		if session.Email != "" {
+			req.Header.Set(headerAuthRequestEmail, session.Email)
+		}
+		if session.PreferredUsername != "" {
+			req.Header.Set(headerAuthRequestName, session.PreferredUsername)
+		}
+		req.Header.DelCookie(o.conf.CookieName)
+		return false, nil
+	}
+
+	// Only the browsers navigating can follow the login
+	if !ctx.IsGet() && !ctx.IsHead() {
+		ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
+		return true, nil
+	}
+	return true, o.login(ctx, host)
+}
+
+// login redirects to the authorization endpoint of the issuer.
+func (o *oidc) login(ctx *fasthttp.RequestCtx, host string) error {
+	provider, err := o.discover()
+	if err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusBadGateway)
+		return err
+	}
+
+	returnURL := string(ctx.RequestURI())
+	if !localURL(returnURL) {
+		returnURL = "/"
+	}
+	state := oidcState{
+		State:  randomString(),
+		Nonce:  randomString(),
+		URL:    returnURL,
+		Expiry: time.Now().Add(oidcStateTTL).Unix(),
+	}
+	value, err := o.seal("state", state)
+	if err != nil {
+		return err
+	}
+	o.setCookie(ctx, o.stateCookieName(), value, oidcStateTTL)
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", o.conf.ClientID)
+	query.Set("redirect_uri", o.redirectURL(ctx, host))
+	query.Set("scope", strings.Join(o.conf.Scopes, " "))
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	location := provider.AuthorizationEndpoint
+	if strings.Contains(location, "?") {
+		location += "&" + query.Encode()
+	} else {
+		location += "?" + query.Encode()
+	}
+	ctx.Redirect(location, fasthttp.StatusFound)
+	return nil
+}
+
+// callback exchanges the code from the issuer for the session.
+func (o *oidc) callback(ctx *fasthttp.RequestCtx, host string) error {
+	args := ctx.QueryArgs()
+	var state oidcState
+	if !o.open("state", string(ctx.Request.Header.Cookie(o.stateCookieName())), &state, &state.Expiry) ||
+		!hmac.Equal([]byte(state.State), args.Peek("state")) {
+		ctx.Response.SetStatusCode(fasthttp.StatusBadRequest)
+		return nil
+	}
+	o.deleteCookie(ctx, o.stateCookieName())
+
+	if e := args.Peek("error"); len(e) != 0 {
+		ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
+		return fmt.Errorf("oidc login: %s", e)
+	}
+
+	provider, err := o.discover()
+	if err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusBadGateway)
+		return err
+	}
+	claims, err := o.exchange(provider, string(args.Peek("code")), o.redirectURL(ctx, host))
+	if err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusBadGateway)
+		return err
+	}
+	err = o.verify(provider, claims, state.Nonce)
+	if err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
+		return err
+	}
+	if len(o.conf.AllowedEmails) != 0 && !matchAny(o.conf.AllowedEmails, claims.Email) {
+		ctx.Response.SetStatusCode(fasthttp.StatusForbidden)
+		return nil
+	}
+
+	session := oidcSession{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		PreferredUsername: claims.PreferredUsername,
+		Expiry:            time.Now().Add(o.conf.SessionTTL).Unix(),
+	}
+	value, err := o.seal("session", session)
+	if err != nil {
+		return err
+	}
+	o.setCookie(ctx, o.conf.CookieName, value, o.conf.SessionTTL)
+	ctx.Redirect(state.URL, fasthttp.StatusFound)
+	return nil
+}
+
+// exchange gets the claims of the ID token from the token endpoint.
+// The ID token comes directly from the issuer over TLS, so its signature is not checked,
+// OpenID Connect Core 1.0 section 3.1.3.7, the endpoint is checked by secureEndpoint.
+func (o *oidc) exchange(provider *oidcProvider, code, redirectURL string) (*oidcClaims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", o.conf.ClientID)
+	form.Set("client_secret", o.conf.ClientSecret)
+	resp, err := o.client.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token endpoint: %s", resp.Status)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	var claims oidcClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, errInvalidIDToken
+	}
+	return &claims, nil
+}
+
+func (o *oidc) verify(provider *oidcProvider, claims *oidcClaims, nonce string) error {
+	if claims.Issuer != provider.Issuer {
+		return fmt.Errorf("%w: issuer %q", errInvalidIDToken, claims.Issuer)
+	}
+	audience := false
+	for _, aud := range claims.Audience {
+		if aud == o.conf.ClientID {
+			audience = true
+			break
+		}
+	}
+	if !audience {
+		return fmt.Errorf("%w: audience %q", errInvalidIDToken, claims.Audience)
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return fmt.Errorf("%w: expired", errInvalidIDToken)
+	}
+	if !hmac.Equal([]byte(claims.Nonce), []byte(nonce)) {
+		return fmt.Errorf("%w: nonce mismatch", errInvalidIDToken)
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("%w: no subject", errInvalidIDToken)
+	}
+	return nil
+}
+
+// discover returns the discovery document of the issuer, it's fetched once it succeeds.
+// The concurrent requests wait for the same fetch and a failure is kept for a while,
+// so a slow or down issuer holds no lock of the other requests.
+func (o *oidc) discover() (*oidcProvider, error) {
+	provider, err := o.discovered()
+	if provider != nil || err != nil {
+		return provider, err
+	}
+	call, leader := o.flight.start("")
+	if !leader {
+		<-call.done
+		provider, err := o.discovered()
+		if provider == nil && err == nil {
+			err = call.err
+		}
+		return provider, err
+	}
+	provider, err = o.fetchProvider()
+	o.mut.Lock()
+	if err != nil {
+		o.failure = err
+		o.retryAfter = time.Now().Add(oidcDiscoveryRetry)
+	} else {
+		o.provider = provider
+	}
+	o.mut.Unlock()
+	o.flight.finish("", call, err)
+	return provider, err
+}
+
+// discovered returns the discovery document or the recent failure, both are nil to fetch it.
+func (o *oidc) discovered() (*oidcProvider, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	if o.failure != nil && time.Now().Before(o.retryAfter) {
+		return nil, o.failure
+	}
+	return nil, nil
+}
+
+func (o *oidc) fetchProvider() (*oidcProvider, error) {
+	resp, err := o.client.Get(strings.TrimSuffix(o.conf.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+	var provider oidcProvider
+	err = json.NewDecoder(resp.Body).Decode(&provider)
+	if err != nil {
+		return nil, err
+	}
+	if provider.Issuer != o.conf.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", provider.Issuer, o.conf.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return nil, fmt.Errorf("oidc discovery: missing endpoints")
+	}
+	err = secureEndpoint(provider.TokenEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: token endpoint: %w", err)
+	}
+	return &provider, nil
+}
+
+// secureEndpoint checks the url is https, plain http is only allowed on the loopback.
+func secureEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not https", endpoint)
+}
+
+// localURL reports whether the url is a path of the same origin,
+// the browsers take "//" and "/\\" as the start of another host and drop the control characters.
+func localURL(u string) bool {
+	if !strings.HasPrefix(u, "/") {
+		return false
+	}
+	for i := 0; i != len(u); i++ {
+		if u[i] < 0x20 || u[i] == 0x7f {
+			return false
+		}
+	}
+	return len(u) == 1 || (u[1] != '/' && u[1] != '\\')
+}
+
+func (o *oidc) redirectURL(ctx *fasthttp.RequestCtx, host string) string {
+	if o.conf.RedirectURL != "" {
+		return o.conf.RedirectURL
+	}
+	scheme := "http"
+	if ctx.IsTLS() {
+		scheme = "https"
+	}
+	return scheme + "://" + host + o.conf.RedirectPath
+}
+
+func (o *oidc) stateCookieName() string {
+	return o.conf.CookieName + "_state"
+}
+
+func (o *oidc) setCookie(ctx *fasthttp.RequestCtx, name, value string, ttl time.Duration) {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(name)
+	cookie.SetValue(value)
+	cookie.SetPath("/")
+	cookie.SetMaxAge(int(ttl.Seconds()))
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(ctx.IsTLS())
+	cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	ctx.Response.Header.SetCookie(cookie)
+}
+
+func (o *oidc) deleteCookie(ctx *fasthttp.RequestCtx, name string) {
+	o.setCookie(ctx, name, "", -time.Second)
+}
+
+// seal encodes the value with its signature,
+// the purpose is signed too so a state can not be used as a session.
+func (o *oidc) seal(purpose string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + o.sign(purpose, payload), nil
+}
+
+// open decodes the value sealed and not expired.
+func (o *oidc) open(purpose string, s string, v interface{}, expiry *int64) bool {
+	payload, signature, ok := strings.Cut(s, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(o.sign(purpose, payload))) {
+		return false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	if json.Unmarshal(data, v) != nil {
+		return false
+	}
+	return time.Now().Unix() < *expiry
+}
+
+func (o *oidc) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,261 @@
+package easiest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newMockIssuer(clientID string, nonce *string) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/authorize",
+			TokenEndpoint:         server.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "code" || r.PostFormValue("client_id") != clientID {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   server.URL,
+			"sub":   "user",
+			"aud":   clientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": *nonce,
+			"email": "user@example.com",
+		})
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".",
+		})
+	})
+	return server
+}
+
+func Test_oidc_login(t *testing.T) {
+	var nonce string
+	issuer := newMockIssuer("client", &nonce)
+	defer issuer.Close()
+
+	o, err := newOIDC(OIDCConfig{
+		Issuer:        issuer.URL,
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		CookieSecret:  "0123456789abcdef",
+		AllowedEmails: []string{"*@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redirect to the issuer
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/dashboard?tab=1")
+	handled, err := o.handle(&ctx, "example.com")
+	if err != nil || !handled {
+		t.Fatalf("handle() = %v, %v, want redirect", handled, err)
+	}
+	location, err := url.Parse(string(ctx.Response.Header.Peek(fasthttp.HeaderLocation)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := location.Scheme+"://"+location.Host+location.Path, issuer.URL+"/authorize"; got != want {
+		t.Fatalf("location = %q, want %q", got, want)
+	}
+	query := location.Query()
+	if got, want := query.Get("redirect_uri"), "http://example.com/oauth2/callback"; got != want {
+		t.Fatalf("redirect_uri = %q, want %q", got, want)
+	}
+	nonce = query.Get("nonce")
+	stateCookie := responseCookie(&ctx, "_easiest_session_state")
+
+	// Callback from the issuer
+	var callback fasthttp.RequestCtx
+	callback.Request.Header.SetHost("example.com")
+	callback.Request.SetRequestURI("/oauth2/callback?code=code&state=" + url.QueryEscape(query.Get("state")))
+	callback.Request.Header.SetCookie("_easiest_session_state", stateCookie)
+	handled, err = o.handle(&callback, "example.com")
+	if err != nil || !handled {
+		t.Fatalf("callback handle() = %v, %v, want redirect", handled, err)
+	}
+	if got, want := string(callback.Response.Header.Peek(fasthttp.HeaderLocation)), "http://example.com/dashboard?tab=1"; got != want {
+		t.Fatalf("callback location = %q, want %q", got, want)
+	}
+	session := responseCookie(&callback, "_easiest_session")
+	if session == "" {
+		t.Fatal("no session cookie")
+	}
+
+	// Request with the session
+	var req fasthttp.RequestCtx
+	req.Request.SetRequestURI("/dashboard")
+	req.Request.Header.SetCookie("_easiest_session", session)
+	req.Request.Header.Set(headerAuthRequestUser, "spoofed")
+	handled, err = o.handle(&req, "example.com")
+	if err != nil || handled {
+		t.Fatalf("session handle() = %v, %v, want pass", handled, err)
+	}
+	if got := string(req.Request.Header.Peek(headerAuthRequestUser)); got != "user" {
+		t.Errorf("%s = %q, want %q", headerAuthRequestUser, got, "user")
+	}
+	if got := string(req.Request.Header.Peek(headerAuthRequestEmail)); got != "user@example.com" {
+		t.Errorf("%s = %q, want %q", headerAuthRequestEmail, got, "user@example.com")
+	}
+
+	// The state can not be used as a session
+	var forged fasthttp.RequestCtx
+	forged.Request.SetRequestURI("/dashboard")
+	forged.Request.Header.SetCookie("_easiest_session", stateCookie)
+	handled, _ = o.handle(&forged, "example.com")
+	if !handled {
+		t.Error("state cookie accepted as session")
+	}
+}
+
+func responseCookie(ctx *fasthttp.RequestCtx, key string) string {
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(key)
+	if !ctx.Response.Header.Cookie(cookie) {
+		return ""
+	}
+	return string(cookie.Value())
+}
+
+func Test_localURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "/", want: true},
+		{url: "/a?b=/c", want: true},
+		{url: "/a\\b", want: true},
+		{url: "//evil.com", want: false},
+		{url: "/\\evil.com", want: false},
+		{url: "/\t/evil.com", want: false},
+		{url: "https://evil.com", want: false},
+		{url: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := localURL(tt.url); got != tt.want {
+			t.Errorf("localURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func Test_oidc_discover(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer issuer.Close()
+
+	o, err := newOIDC(OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "client",
+		CookieSecret: "0123456789abcdef",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i != 2; i++ {
+		go func() {
+			_, err := o.discover()
+			errs <- err
+		}()
+	}
+	// The fetch in flight holds no lock
+	locked := make(chan struct{})
+	go func() {
+		o.discovered()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the lock is held during the discovery")
+	}
+	close(release)
+	for i := 0; i != 2; i++ {
+		if err := <-errs; err == nil {
+			t.Error("discover() = nil error, want the failure")
+		}
+	}
+
+	// The failure is kept for a while
+	if _, err := o.discover(); err == nil {
+		t.Error("discover() = nil error, want the failure")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+}
+
+func Test_secureEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: "https://issuer.test/token"},
+		{endpoint: "http://127.0.0.1:8080/token"},
+		{endpoint: "http://[::1]/token"},
+		{endpoint: "http://localhost/token"},
+		{endpoint: "http://issuer.test/token", wantErr: true},
+		{endpoint: "http://10.0.0.5/token", wantErr: true},
+		{endpoint: "ftp://issuer.test/token", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := secureEndpoint(tt.endpoint); (err != nil) != tt.wantErr {
+			t.Errorf("secureEndpoint(%q) = %v, wantErr %v", tt.endpoint, err, tt.wantErr)
+		}
+	}
+}
+
+func Test_oidc_insecureTokenEndpoint(t *testing.T) {
+	_, err := newOIDC(OIDCConfig{
+		Issuer:       "http://issuer.test",
+		ClientID:     "client",
+		CookieSecret: "0123456789abcdef",
+	})
+	if err == nil {
+		t.Error("newOIDC() = nil error, want the plain http issuer rejected")
+	}
+
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProvider{
+			Issuer:                issuer.URL,
+			AuthorizationEndpoint: issuer.URL + "/authorize",
+			TokenEndpoint:         "http://issuer.test/token",
+		})
+	}))
+	defer issuer.Close()
+	o, err := newOIDC(OIDCConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "client",
+		CookieSecret: "0123456789abcdef",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.discover()
+	if err == nil {
+		t.Error("discover() = nil error, want the plain http token endpoint rejected")
+	}
+}
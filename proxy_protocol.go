@@ -0,0 +1,247 @@
+package easiest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var errInvalidProxyProtocol = errors.New("invalid proxy protocol header")
+
+// proxyProtocolConn is a net.Conn with the addresses from the PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// acceptProxyProtocol reads the PROXY protocol header if the peer is a trusted source,
+// no peer is trusted without sources, and a connection without the header is returned as it is.
+func (s *Server) acceptProxyProtocol(conn net.Conn) (net.Conn, error) {
+	if !s.proxyProtocol {
+		return conn, nil
+	}
+	if !s.proxyProtocolSources.Contains(addrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	return readProxyProtocol(conn)
+}
+
+func readProxyProtocol(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReaderSize(conn, 256)
+	src, dst, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	buffered, _ := reader.Peek(reader.Buffered())
+	conn = wrapUnreadConn(conn, append([]byte(nil), buffered...))
+	if src == nil || dst == nil {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:       conn,
+		remoteAddr: src,
+		localAddr:  dst,
+	}, nil
+}
+
+// readProxyProtocolHeader returns the addresses in the header,
+// nil addresses means there is no header or the addresses are unknown.
+func readProxyProtocolHeader(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case proxyProtocolV1Prefix[0]:
+		prefix, err := reader.Peek(len(proxyProtocolV1Prefix))
+		if err != nil || !bytes.Equal(prefix, proxyProtocolV1Prefix) {
+			return nil, nil, nil
+		}
+		return readProxyProtocolV1(reader)
+	case proxyProtocolV2Signature[0]:
+		signature, err := reader.Peek(len(proxyProtocolV2Signature))
+		if err != nil || !bytes.Equal(signature, proxyProtocolV2Signature) {
+			return nil, nil, nil
+		}
+		return readProxyProtocolV2(reader)
+	}
+	return nil, nil, nil
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	// The header is at most 107 bytes, including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyProtocol
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errInvalidProxyProtocol
+	}
+	if len(fields) != 6 {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)},
+		&net.TCPAddr{IP: dstIP, Port: int(dstPort)},
+		nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, the connection is from the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errInvalidProxyProtocol
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	switch header[13] & 0x0f {
+	case 1:
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+	case 2:
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return nil, nil, nil
+}
+
+// sendProxyProtocol writes the PROXY protocol header with the addresses of downstream,
+// version 0 means nothing is sent.
+func sendProxyProtocol(upstream net.Conn, version int, downstream net.Conn) error {
+	if version == 0 {
+		return nil
+	}
+	header, err := proxyProtocolHeader(version, downstream.RemoteAddr(), downstream.LocalAddr())
+	if err != nil {
+		return err
+	}
+	_, err = upstream.Write(header)
+	return err
+}
+
+// proxyProtocolHeader returns the PROXY protocol header of the version for the addresses.
+func proxyProtocolHeader(version int, src, dst net.Addr) ([]byte, error) {
+	srcIP, dstIP := addrIP(src), addrIP(dst)
+	srcPort, dstPort := addrPort(src), addrPort(dst)
+	switch version {
+	case 1:
+		if srcIP == nil || dstIP == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP6"
+		if srcIP.To4() != nil && dstIP.To4() != nil {
+			proto = "TCP4"
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort)), nil
+	case 2:
+		header := append([]byte(nil), proxyProtocolV2Signature...)
+		if srcIP == nil || dstIP == nil {
+			// LOCAL command
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+		fam := byte(0x21)
+		if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+			fam = 0x11
+			srcIP, dstIP = src4, dst4
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+		if _, ok := src.(*net.UDPAddr); ok {
+			fam++
+		}
+		header = append(header, 0x21, fam)
+		header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+		header = binary.BigEndian.AppendUint16(header, uint16(dstPort))
+		return header, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy protocol version %d", version)
+}
+
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+package easiest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_proxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		src     net.Addr
+		dst     net.Addr
+	}{
+		{
+			name:    "v1 tcp4",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+		},
+		{
+			name:    "v1 tcp6",
+			version: 1,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:    "v2 tcp4",
+			version: 2,
+			src:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+		},
+		{
+			name:    "v2 tcp6",
+			version: 2,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := proxyProtocolHeader(tt.version, tt.src, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := []byte("GET / HTTP/1.1\r\n\r\n")
+			reader := bufio.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(payload)))
+			src, dst, err := readProxyProtocolHeader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if src.String() != tt.src.String() {
+				t.Errorf("src = %v, want %v", src, tt.src)
+			}
+			if dst.String() != tt.dst.String() {
+				t.Errorf("dst = %v, want %v", dst, tt.dst)
+			}
+			rest, _ := io.ReadAll(reader)
+			if !bytes.Equal(rest, payload) {
+				t.Errorf("rest = %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func Test_readProxyProtocolHeader_without(t *testing.T) {
+	payload := []byte("POST / HTTP/1.1\r\n\r\n")
+	reader := bufio.NewReader(bytes.NewReader(payload))
+	src, dst, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != nil || dst != nil {
+		t.Errorf("got %v %v, want nil", src, dst)
+	}
+	rest, _ := io.ReadAll(reader)
+	if !bytes.Equal(rest, payload) {
+		t.Errorf("rest = %q, want %q", rest, payload)
+	}
+}
+
+// addrConn is a net.Conn with the remote address.
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func Test_acceptProxyProtocol(t *testing.T) {
+	trusted, err := parseIPNets([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoofed := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	tests := []struct {
+		name    string
+		sources ipNets
+		peer    string
+		want    string
+	}{
+		{
+			name:    "trusted",
+			sources: trusted,
+			peer:    "10.0.0.1",
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "untrusted",
+			sources: trusted,
+			peer:    "203.0.113.1",
+			want:    "203.0.113.1",
+		},
+		{
+			name: "no sources",
+			peer: "203.0.113.1",
+			want: "203.0.113.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := proxyProtocolHeader(1, spoofed, &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			go c2.Write(header)
+
+			s := &Server{
+				proxyProtocol:        true,
+				proxyProtocolSources: tt.sources,
+			}
+			conn, err := s.acceptProxyProtocol(&addrConn{
+				Conn:       c1,
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 5678},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := addrIP(conn.RemoteAddr()).String(); got != tt.want {
+				t.Errorf("remote = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRouteEntry_sendProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{
+			name:  "stream v1",
+			route: Route{Domain: "a.test", Target: "tcp://127.0.0.1:22", Stream: true, SendProxyProtocol: 1},
+		},
+		{
+			name:  "listen v2",
+			route: Route{Listen: ":2222", Target: "tcp://127.0.0.1:22", SendProxyProtocol: 2},
+		},
+		{
+			name:    "unsupported version",
+			route:   Route{Listen: ":2222", Target: "tcp://127.0.0.1:22", SendProxyProtocol: 3},
+			wantErr: true,
+		},
+		{
+			name:    "http",
+			route:   Route{Domain: "a.test", Target: "http://127.0.0.1:8080", SendProxyProtocol: 1},
+			wantErr: true,
+		},
+		{
+			name:    "udp",
+			route:   Route{Listen: ":5353", Target: "udp://127.0.0.1:53", SendProxyProtocol: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouteEntry(tt.route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRouteEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package easiest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var errRateLimit = errors.New("rate limited")
+
+// rateLimiter is the token buckets of a rate limit rule.
+type rateLimiter struct {
+	conf    RateLimitConfig
+	mut     sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(conf RateLimitConfig) (*rateLimiter, error) {
+	if conf.Rate <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+	switch conf.Key {
+	case "", "ip", "route":
+	case "header":
+		if conf.Header == "" {
+			return nil, fmt.Errorf("key header needs header")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key %q", conf.Key)
+	}
+	if conf.Burst <= 0 {
+		conf.Burst = int(math.Ceil(conf.Rate))
+	}
+	return &rateLimiter{
+		conf:    conf,
+		buckets: map[string]*tokenBucket{},
+	}, nil
+}
+
+// allow takes a token of the key, or returns how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	return allowAll([]*rateLimiter{l}, []string{key}, now)
+}
+
+// allowAll takes a token of each limiter for its key only if all of them have one,
+// so a request rejected by a rule takes nothing from the others.
+// It returns the longest wait otherwise.
+func allowAll(limiters []*rateLimiter, keys []string, now time.Time) (bool, time.Duration) {
+	for _, l := range limiters {
+		l.mut.Lock()
+		defer l.mut.Unlock()
+	}
+
+	buckets := make([]*tokenBucket, len(limiters))
+	var wait time.Duration
+	for i, l := range limiters {
+		buckets[i] = l.bucket(keys[i], now)
+		if buckets[i].tokens < 1 {
+			w := time.Duration((1 - buckets[i].tokens) / l.conf.Rate * float64(time.Second))
+			if w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// bucket returns the bucket of the key refilled to now, the lock must be held.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	l.calls++
+	if l.calls%1024 == 0 {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens: float64(l.conf.Burst),
+			last:   now,
+		}
+		l.buckets[key] = bucket
+	} else {
+		l.refill(bucket, now)
+	}
+	return bucket
+}
+
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(float64(l.conf.Burst), bucket.tokens+elapsed*l.conf.Rate)
+		bucket.last = now
+	}
+}
+
+// prune removes the buckets that are full again, they are the same as new ones.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= float64(l.conf.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// snapshot returns the tokens left of each key.
+func (l *rateLimiter) snapshot(now time.Time) map[string]float64 {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	tokens := make(map[string]float64, len(l.buckets))
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		tokens[key] = bucket.tokens
+	}
+	return tokens
+}
+
+// requestKey returns the key of the request, false if the rule does not apply.
+func (l *rateLimiter) requestKey(ip net.IP, req *fasthttp.Request) (string, bool) {
+	if l.conf.PathPrefix != "" && !strings.HasPrefix(string(req.URI().Path()), l.conf.PathPrefix) {
+		return "", false
+	}
+	switch l.conf.Key {
+	case "route":
+		return "", true
+	case "header":
+		return string(req.Header.Peek(l.conf.Header)), true
+	}
+	return ip.String(), true
+}
+
+// connKey returns the key of the new connection, false if the rule does not apply.
+func (l *rateLimiter) connKey(ip net.IP) (string, bool) {
+	if l.conf.PathPrefix != "" {
+		return "", false
+	}
+	switch l.conf.Key {
+	case "route":
+		return "", true
+	case "header":
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// allowRequest checks all the rate limits of the route for the request.
+func (r *routeEntry) allowRequest(ip net.IP, req *fasthttp.Request) (bool, time.Duration) {
+	var limiters []*rateLimiter
+	var keys []string
+	for _, l := range r.rateLimiters {
+		key, ok := l.requestKey(ip, req)
+		if !ok {
+			continue
+		}
+		limiters = append(limiters, l)
+		keys = append(keys, key)
+	}
+	if len(limiters) == 0 {
+		return true, 0
+	}
+	return allowAll(limiters, keys, time.Now())
+}
+
+// allowConn checks all the rate limits of the route for the new connection.
+func (r *routeEntry) allowConn(ip net.IP) bool {
+	var limiters []*rateLimiter
+	var keys []string
+	for _, l := range r.rateLimiters {
+		key, ok := l.connKey(ip)
+		if !ok {
+			continue
+		}
+		limiters = append(limiters, l)
+		keys = append(keys, key)
+	}
+	if len(limiters) == 0 {
+		return true
+	}
+	ok, _ := allowAll(limiters, keys, time.Now())
+	return ok
+}
+
+// retryAfter formats the wait as the value of Retry-After in seconds.
+func retryAfter(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
@@ -0,0 +1,69 @@
+package easiest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_rateLimiter_allow(t *testing.T) {
+	l, err := newRateLimiter(RateLimitConfig{
+		Rate:  2,
+		Burst: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i != 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("allow %d, want ok", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("allow over burst, want limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want %v", wait, 500*time.Millisecond)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Fatal("allow other key, want ok")
+	}
+	if ok, _ := l.allow("a", now.Add(wait)); !ok {
+		t.Fatal("allow after wait, want ok")
+	}
+}
+
+func Test_routeEntry_allowRequest(t *testing.T) {
+	route, err := newRouteEntry(Route{
+		Domain: "a.test",
+		Target: "http://127.0.0.1:8080",
+		RateLimits: []RateLimitConfig{
+			{Rate: 0.001, Burst: 10, Key: "route"},
+			{Rate: 0.001, Burst: 1},
+		},
+	}, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	ip := net.ParseIP("10.0.0.1")
+
+	if ok, _ := route.allowRequest(ip, req); !ok {
+		t.Fatal("first request, want allowed")
+	}
+	for i := 0; i != 3; i++ {
+		if ok, _ := route.allowRequest(ip, req); ok {
+			t.Fatal("request over the ip rule, want limited")
+		}
+	}
+	// The rejected requests take nothing from the route rule
+	tokens := route.rateLimiters[0].snapshot(time.Now())
+	if got := tokens[""]; got < 9 || got >= 9.1 {
+		t.Errorf("route tokens = %v, want 9", got)
+	}
+}
@@ -0,0 +1,150 @@
+package easiest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resolver dials with the static hosts, the custom DNS servers and the DNS cache.
+type resolver struct {
+	hosts    map[string][]net.IP
+	resolver *net.Resolver
+	dialer   net.Dialer
+	ttl      time.Duration
+	prefer   string
+
+	mut   sync.Mutex
+	cache map[string]resolverCacheEntry
+}
+
+type resolverCacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+func newResolver(conf ResolverConfig) (*resolver, error) {
+	r := &resolver{
+		hosts:    map[string][]net.IP{},
+		resolver: net.DefaultResolver,
+		ttl:      conf.CacheTTL,
+		prefer:   conf.Prefer,
+		cache:    map[string]resolverCacheEntry{},
+	}
+	switch conf.Prefer {
+	case "", "ipv4", "ipv6":
+	default:
+		return nil, fmt.Errorf("unsupported prefer %q", conf.Prefer)
+	}
+	for host, addr := range conf.Hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q of host %q", addr, host)
+		}
+		r.hosts[host] = append(r.hosts[host], ip)
+	}
+	if len(conf.Servers) != 0 {
+		servers := make([]string, 0, len(conf.Servers))
+		for _, server := range conf.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			servers = append(servers, server)
+		}
+		var next uint32
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				server := servers[int(atomic.AddUint32(&next, 1))%len(servers)]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r, nil
+}
+
+// lookup returns the IPs of the host ordered by the preference.
+func (r *resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+
+	if r.ttl > 0 {
+		r.mut.Lock()
+		entry, ok := r.cache[host]
+		r.mut.Unlock()
+		if ok && time.Now().Before(entry.expire) {
+			return entry.ips, nil
+		}
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	if r.prefer != "" {
+		sort.SliceStable(ips, func(i, j int) bool {
+			return r.preferred(ips[i]) && !r.preferred(ips[j])
+		})
+	}
+
+	if r.ttl > 0 {
+		r.mut.Lock()
+		r.cache[host] = resolverCacheEntry{
+			ips:    ips,
+			expire: time.Now().Add(r.ttl),
+		}
+		r.mut.Unlock()
+	}
+	return ips, nil
+}
+
+func (r *resolver) preferred(ip net.IP) bool {
+	isIPv4 := ip.To4() != nil
+	if r.prefer == "ipv6" {
+		return !isIPv4
+	}
+	return isIPv4
+}
+
+func (r *resolver) Dial(network, addr string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, addr)
+}
+
+// DialContext tries the IPs of the host in order until one succeeds.
+func (r *resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,266 @@
+package easiest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func Test_resolver_lookup(t *testing.T) {
+	r, err := newResolver(ResolverConfig{
+		Hosts: map[string]string{
+			"upstream.com": "10.0.0.5",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		host string
+		want net.IP
+	}{
+		{
+			name: "static host",
+			host: "upstream.com",
+			want: net.ParseIP("10.0.0.5"),
+		},
+		{
+			name: "ip",
+			host: "192.0.2.1",
+			want: net.ParseIP("192.0.2.1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.lookup(context.Background(), tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || !got[0].Equal(tt.want) {
+				t.Errorf("lookup(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+// startDNS starts a DNS server answering the A and AAAA records of the host on UDP,
+// it counts the queries and returns the address it listens on.
+func startDNS(t *testing.T, host string, ips []net.IP, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := p.Question()
+			if err != nil {
+				continue
+			}
+			header.Response = true
+			header.Authoritative = true
+			if question.Name.String() != host+"." {
+				header.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, header)
+			b.StartQuestions()
+			b.Question(question)
+			b.StartAnswers()
+			for _, ip := range ips {
+				if header.RCode != dnsmessage.RCodeSuccess {
+					break
+				}
+				rh := dnsmessage.ResourceHeader{
+					Name:  question.Name,
+					Type:  question.Type,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				}
+				if ip4 := ip.To4(); ip4 != nil {
+					if question.Type == dnsmessage.TypeA {
+						var a dnsmessage.AResource
+						copy(a.A[:], ip4)
+						b.AResource(rh, a)
+					}
+				} else if question.Type == dnsmessage.TypeAAAA {
+					var aaaa dnsmessage.AAAAResource
+					copy(aaaa.AAAA[:], ip.To16())
+					b.AAAAResource(rh, aaaa)
+				}
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func Test_resolver_servers(t *testing.T) {
+	var queries1, queries2 int32
+	r, err := newResolver(ResolverConfig{
+		Servers: []string{
+			startDNS(t, "upstream.test", []net.IP{net.ParseIP("10.0.0.5")}, &queries1),
+			startDNS(t, "upstream.test", []net.IP{net.ParseIP("10.0.0.5")}, &queries2),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i != 2; i++ {
+		got, err := r.lookup(context.Background(), "upstream.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !got[0].Equal(net.ParseIP("10.0.0.5")) {
+			t.Errorf("lookup() = %v, want [10.0.0.5]", got)
+		}
+	}
+	if atomic.LoadInt32(&queries1) == 0 || atomic.LoadInt32(&queries2) == 0 {
+		t.Errorf("queries = %d and %d, want both servers queried", queries1, queries2)
+	}
+}
+
+func Test_resolver_cache(t *testing.T) {
+	var queries int32
+	r, err := newResolver(ResolverConfig{
+		Servers:  []string{startDNS(t, "upstream.test", []net.IP{net.ParseIP("10.0.0.5")}, &queries)},
+		CacheTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func() {
+		got, err := r.lookup(context.Background(), "upstream.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !got[0].Equal(net.ParseIP("10.0.0.5")) {
+			t.Errorf("lookup() = %v, want [10.0.0.5]", got)
+		}
+	}
+
+	lookup()
+	queried := atomic.LoadInt32(&queries)
+	if queried == 0 {
+		t.Fatal("the server is not queried")
+	}
+	lookup()
+	if got := atomic.LoadInt32(&queries); got != queried {
+		t.Errorf("queries = %d, want %d for a hit", got, queried)
+	}
+
+	r.mut.Lock()
+	entry := r.cache["upstream.test"]
+	entry.expire = time.Now().Add(-time.Second)
+	r.cache["upstream.test"] = entry
+	r.mut.Unlock()
+	lookup()
+	if got := atomic.LoadInt32(&queries); got == queried {
+		t.Error("the expired entry is not looked up again")
+	}
+}
+
+func Test_resolver_prefer(t *testing.T) {
+	var queries int32
+	server := startDNS(t, "upstream.test", []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")}, &queries)
+	tests := []struct {
+		prefer string
+		want   net.IP
+	}{
+		{
+			prefer: "ipv4",
+			want:   net.ParseIP("10.0.0.5"),
+		},
+		{
+			prefer: "ipv6",
+			want:   net.ParseIP("fd00::5"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefer, func(t *testing.T) {
+			r, err := newResolver(ResolverConfig{
+				Servers: []string{server},
+				Prefer:  tt.prefer,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := r.lookup(context.Background(), "upstream.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || !got[0].Equal(tt.want) {
+				t.Errorf("lookup() = %v, want %v first", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resolver_route(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	_, httpPort, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	_, echoPort, _ := net.SplitHostPort(startEcho(t, "tcp", "127.0.0.1:0"))
+
+	resolver := &ResolverConfig{
+		Hosts: map[string]string{
+			"upstream.test": "127.0.0.1",
+		},
+	}
+	t.Run("http", func(t *testing.T) {
+		addr := bindTestRoute(t, Config{
+			Resolver: resolver,
+			Routes: []Route{
+				{
+					Domain: "a.test",
+					Target: "http://upstream.test:" + httpPort,
+				},
+			},
+		}, "a.test")
+		if got := getThrough(t, addr, "a.test"); got != "ok" {
+			t.Errorf("body = %q, want %q", got, "ok")
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		addr := bindTestRoute(t, Config{
+			Resolver: resolver,
+			Routes: []Route{
+				{
+					Domain: "a.test",
+					Target: "tcp://upstream.test:" + echoPort,
+					Stream: true,
+				},
+			},
+		}, "a.test")
+		err := echoThrough(func(addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		}, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -4,17 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttpproxy"
+	"golang.org/x/net/proxy"
 )
 
 const (
@@ -23,32 +27,278 @@ const (
 )
 
 type Server struct {
-	route        map[string]Route
-	debugAddress string
-	tlsConfig    *tls.Config
-	logger       Logger
-	httpServer   fasthttp.Server
-	httpClient   fasthttp.Client
+	route                map[string]*routeEntry
+	listenRoutes         []*routeEntry
+	debugAddress         string
+	timeouts             TimeoutConfig
+	limits               *connLimits
+	bandwidth            *byteLimiter
+	access               *access
+	trustedProxies       ipNets
+	proxyProtocol        bool
+	proxyProtocolSources ipNets
+	tlsConfig            *tls.Config
+	metrics              *metrics
+	accessLog            *accessLog
+	logger               Logger
 }
 
 type Logger interface {
 	Println(v ...interface{})
 }
 
-func NewServer(conf Config, logger Logger) *Server {
-	route := map[string]Route{}
+// routeEntry is a Route with the state built from its config.
+type routeEntry struct {
+	Route
+	cors       *cors
+	dial       fasthttp.DialFunc
+	httpClient fasthttp.Client
+	httpServer *fasthttp.Server
+	udp        *udpRoute
+	timeouts   TimeoutConfig
+	limits     *connLimits
+
+	rateLimiters []*rateLimiter
+	bandwidth    *byteLimiter
+	access       *access
+	auth         *auth
+	oidc         *oidc
+	signedURL    *signedURL
+	cache        *cache
+	clientAuth   *clientAuth
+}
+
+func newRouteEntry(r Route, forward proxy.Dialer, timeouts TimeoutConfig, m *metrics) (*routeEntry, error) {
+	if r.Listen != "" {
+		// Routes with their own listener are not sniffed, so it can only be stream
+		r.Stream = true
+	}
+	if r.Stream {
+		// The options would be ignored, leaving the stream open
+		if option := r.httpOnlyOption(); option != "" {
+			return nil, fmt.Errorf("route %q %s: only for HTTP routes", r.name(), option)
+		}
+	}
+	if r.Stream && r.Listen == "" && r.Timeouts.HeaderRead > 0 {
+		// The stream is routed by the sniffed header, so only the global timeout applies
+		return nil, fmt.Errorf("route %q header read timeout: only for HTTP and listen routes", r.name())
+	}
+	timeouts = timeouts.merge(r.Timeouts)
+	forward = withDialTimeout(forward, timeouts.Dial)
+	u, err := url.Parse(r.Target)
+	if err != nil {
+		return nil, fmt.Errorf("route %q target: %w", r.name(), err)
+	}
+	switch r.SendProxyProtocol {
+	case 0, 1, 2:
+	default:
+		return nil, fmt.Errorf("route %q send proxy protocol: unsupported version %d", r.name(), r.SendProxyProtocol)
+	}
+	if r.SendProxyProtocol != 0 && (!r.Stream || u.Scheme == "udp") {
+		return nil, fmt.Errorf("route %q send proxy protocol: only for tcp stream routes", r.name())
+	}
+	if len(r.Targets) != 0 && u.Scheme != "udp" {
+		return nil, fmt.Errorf("route %q targets: only for scheme udp", r.name())
+	}
+	var dial fasthttp.DialFunc
+	var udp *udpRoute
+	switch u.Scheme {
+	case "udp":
+		// The datagrams are relayed as they are, straight to the targets
+		if option := r.tcpOnlyOption(); option != "" {
+			return nil, fmt.Errorf("route %q %s: only for tcp routes", r.name(), option)
+		}
+		udp, err = newUDPRoute(r, timeouts.Idle)
+		if err != nil {
+			return nil, fmt.Errorf("route %q target: %w", r.name(), err)
+		}
+		dial = newUDPDial(forward)
+	case "unix", "http+unix":
+		dial = newUnixDial(u.Path, timeouts.Dial)
+	case "tcp":
+		if !r.Stream {
+			return nil, fmt.Errorf("route %q target: scheme %q is only for stream", r.name(), u.Scheme)
+		}
+		fallthrough
+	default:
+		dial, err = newUpstreamDial(r, forward, timeouts.Dial)
+		if err != nil {
+			return nil, fmt.Errorf("route %q proxy: %w", r.name(), err)
+		}
+	}
+	dial = m.withDialMetrics(dial, r.name())
+	dial = withUpstreamLimit(dial, newKeyedSemaphore(r.Limits.MaxUpstreamConns), r.Limits.QueueTimeout)
+	entry := &routeEntry{
+		Route:    r,
+		dial:     dial,
+		udp:      udp,
+		timeouts: timeouts,
+		limits:   newConnLimits(r.Limits),
+	}
+	entry.bandwidth = newByteLimiter(r.Bandwidth)
+	entry.access, err = newAccess(r.Access)
+	if err != nil {
+		return nil, fmt.Errorf("route %q access: %w", r.name(), err)
+	}
+	if r.Auth != nil {
+		entry.auth = newAuth(*r.Auth)
+	}
+	if r.OIDC != nil {
+		entry.oidc, err = newOIDC(*r.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("route %q oidc: %w", r.name(), err)
+		}
+	}
+	if r.SignedURL != nil {
+		entry.signedURL, err = newSignedURL(*r.SignedURL)
+		if err != nil {
+			return nil, fmt.Errorf("route %q signed url: %w", r.name(), err)
+		}
+	}
+	if r.Cache != nil {
+		entry.cache, err = newCache(*r.Cache)
+		if err != nil {
+			return nil, fmt.Errorf("route %q cache: %w", r.name(), err)
+		}
+		// The credentials may be stripped and the identity is forwarded in headers,
+		// so the responses are personalized even without an Authorization header
+		entry.cache.authenticated = r.Auth != nil || r.OIDC != nil || r.ClientAuth != nil
+	}
+	if r.ClientAuth != nil {
+		if r.Listen != "" {
+			return nil, fmt.Errorf("route %q client auth: only for the TLS listener", r.name())
+		}
+		entry.clientAuth, err = newClientAuth(*r.ClientAuth)
+		if err != nil {
+			return nil, fmt.Errorf("route %q client auth: %w", r.name(), err)
+		}
+	}
+	entry.httpClient.Dial = dial
+	entry.httpClient.ReadTimeout = timeouts.Response
+	entry.httpClient.WriteTimeout = timeouts.Write
+	// The requests are routed by the exact Host, so the preserved one is the domain
+	if serverName := upstreamSNI(r, u.Hostname(), r.Domain); serverName != "" {
+		entry.httpClient.TLSConfig = &tls.Config{
+			ServerName: serverName,
+		}
+	}
+	for _, conf := range r.RateLimits {
+		l, err := newRateLimiter(conf)
+		if err != nil {
+			return nil, fmt.Errorf("route %q rate limit: %w", r.name(), err)
+		}
+		entry.rateLimiters = append(entry.rateLimiters, l)
+	}
+	if r.CORS != nil {
+		c, err := newCORS(*r.CORS)
+		if err != nil {
+			return nil, fmt.Errorf("route %q cors: %w", r.name(), err)
+		}
+		entry.cors = c
+	}
+	return entry, nil
+}
+
+func NewServer(conf Config, logger Logger) (*Server, error) {
+	m := newMetrics()
+	var forward proxy.Dialer = &net.Dialer{}
+	if conf.Resolver != nil {
+		r, err := newResolver(*conf.Resolver)
+		if err != nil {
+			return nil, fmt.Errorf("resolver: %w", err)
+		}
+		forward = r
+	}
+
+	// The upstream limit of the server is shared by the targets of all the routes
+	upstreamLimit := newKeyedSemaphore(conf.Limits.MaxUpstreamConns)
+	route := map[string]*routeEntry{}
+	listenRoutes := []*routeEntry{}
 	for _, r := range conf.Routes {
-		route[r.Domain] = r
+		entry, err := newRouteEntry(r, forward, conf.Timeouts, m)
+		if err != nil {
+			return nil, err
+		}
+		entry.dial = withUpstreamLimit(entry.dial, upstreamLimit, conf.Limits.QueueTimeout)
+		entry.httpClient.Dial = entry.dial
+		if r.Listen != "" {
+			listenRoutes = append(listenRoutes, entry)
+			continue
+		}
+		route[r.Domain] = entry
+	}
+	trustedProxies, err := parseIPNets(conf.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted proxies: %w", err)
+	}
+	proxyProtocolSources, err := parseIPNets(conf.ProxyProtocol.TrustedSources)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol trusted sources: %w", err)
+	}
+	if conf.ProxyProtocol.Accept && len(proxyProtocolSources) == 0 {
+		return nil, fmt.Errorf("proxy protocol: accept requires trusted sources")
+	}
+	access, err := newAccess(conf.Access)
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	var accessLog *accessLog
+	if conf.AccessLog != nil {
+		accessLog, err = newAccessLog(*conf.AccessLog)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
 	}
 	s := &Server{
-		route:        route,
-		debugAddress: conf.DebugAddress,
-		tlsConfig:    newAcme(nil, conf.TlsDir),
-		logger:       logger,
-	}
-	s.httpClient.Dial = fasthttpproxy.FasthttpProxyHTTPDialer()
-	s.httpServer.Handler = s.handler
-	return s
+		route:                route,
+		listenRoutes:         listenRoutes,
+		debugAddress:         conf.DebugAddress,
+		timeouts:             conf.Timeouts,
+		limits:               newConnLimits(conf.Limits),
+		bandwidth:            newByteLimiter(conf.Bandwidth),
+		access:               access,
+		trustedProxies:       trustedProxies,
+		proxyProtocol:        conf.ProxyProtocol.Accept,
+		proxyProtocolSources: proxyProtocolSources,
+		tlsConfig:            withClientAuth(newAcme(nil, conf.TlsDir, m.acmeEvents), route),
+		metrics:              m,
+		accessLog:            accessLog,
+		logger:               logger,
+	}
+	for _, route := range s.routes() {
+		if route.Stream || route.udp != nil {
+			continue
+		}
+		// Each route has its own server for the timeouts of its connections
+		route.httpServer = &fasthttp.Server{
+			Handler:      s.handler,
+			ReadTimeout:  route.timeouts.Read,
+			WriteTimeout: route.timeouts.Write,
+			IdleTimeout:  route.timeouts.Idle,
+		}
+		if route.timeouts.HeaderRead > 0 {
+			// The deadline of the sniffing is cleared, so the rest of the header is read within its own,
+			// then the body within the read timeout, or else the header one is kept for the whole request
+			route.httpServer.ReadTimeout = route.timeouts.HeaderRead
+			if read := route.timeouts.Read; read > 0 {
+				route.httpServer.HeaderReceived = func(*fasthttp.RequestHeader) fasthttp.RequestConfig {
+					return fasthttp.RequestConfig{
+						ReadTimeout: read,
+					}
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// routes returns all the routes of the server.
+func (s *Server) routes() []*routeEntry {
+	routes := make([]*routeEntry, 0, len(s.route)+len(s.listenRoutes))
+	for _, route := range s.route {
+		routes = append(routes, route)
+	}
+	return append(routes, s.listenRoutes...)
 }
 
 func (s *Server) Run(ctx context.Context) error {
@@ -61,7 +311,45 @@ func (s *Server) Run(ctx context.Context) error {
 		return err
 	}
 
+	listenServers := make([]io.Closer, 0, len(s.listenRoutes))
+	for _, route := range s.listenRoutes {
+		if route.udp != nil {
+			listenServer, err := net.ListenPacket("udp", route.Listen)
+			if err != nil {
+				return err
+			}
+			listenServers = append(listenServers, listenServer)
+			continue
+		}
+		listenServer, err := net.Listen("tcp", route.Listen)
+		if err != nil {
+			return err
+		}
+		listenServers = append(listenServers, listenServer)
+	}
+
 	wg := sync.WaitGroup{}
+	for i, route := range s.listenRoutes {
+		route := route
+		listenServer := listenServers[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			switch svc := listenServer.(type) {
+			case net.PacketConn:
+				err = s.startUDP(ctx, route, svc)
+			case net.Listener:
+				err = s.startListen(ctx, route, svc)
+			}
+			if err != nil {
+				if s.logger != nil {
+					s.logger.Println("startListen", route.Listen, err)
+				}
+			}
+		}()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -88,7 +376,7 @@ func (s *Server) Run(ctx context.Context) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := http.ListenAndServe(s.debugAddress, http.DefaultServeMux)
+			err := http.ListenAndServe(s.debugAddress, s.debugHandler())
 			if err != nil {
 				if s.logger != nil {
 					s.logger.Println("ListenAndServe debug", err)
@@ -107,6 +395,10 @@ func (s *Server) startHTTP(ctx context.Context, svc net.Listener) error {
 		if err != nil {
 			return err
 		}
+		if s.limits.full() {
+			resetConn(conn)
+			continue
+		}
 		go func() {
 			defer conn.Close()
 			err := s.handleHTTP(ctx, conn)
@@ -125,6 +417,10 @@ func (s *Server) startTLS(ctx context.Context, svc net.Listener) error {
 		if err != nil {
 			return err
 		}
+		if s.limits.full() {
+			resetConn(conn)
+			continue
+		}
 		go func() {
 			defer conn.Close()
 			err := s.handleTLS(ctx, conn)
@@ -137,7 +433,96 @@ func (s *Server) startTLS(ctx context.Context, svc net.Listener) error {
 	}
 }
 
+func (s *Server) startListen(ctx context.Context, route *routeEntry, svc net.Listener) error {
+	for {
+		conn, err := svc.Accept()
+		if err != nil {
+			return err
+		}
+		if s.limits.full() || route.limits.full() {
+			resetConn(conn)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			err := s.handleListen(ctx, route, conn)
+			if err != nil {
+				if s.logger != nil && !isClosedConnError(err) && err != io.EOF {
+					s.logger.Println("handleListen", err)
+				}
+			}
+		}()
+	}
+}
+
+func (s *Server) handleListen(ctx context.Context, route *routeEntry, conn net.Conn) error {
+	raw := conn
+	err := setReadTimeout(conn, route.timeouts.HeaderRead)
+	if err != nil {
+		return err
+	}
+
+	conn, err = s.acceptProxyProtocol(conn)
+	if err != nil {
+		return err
+	}
+
+	if !s.allowedConn(route, conn) {
+		resetConn(raw)
+		return errAccessDenied
+	}
+	defer s.metrics.trackConn(route.Listen, route.name())()
+
+	release, ok := s.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		resetConn(raw)
+		return errConnLimit
+	}
+	defer release()
+
+	releaseRoute, ok := route.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		resetConn(raw)
+		return errConnLimit
+	}
+	defer releaseRoute()
+
+	if !route.allowConn(addrIP(conn.RemoteAddr())) {
+		resetConn(raw)
+		return errRateLimit
+	}
+
+	err = setReadTimeout(conn, 0)
+	if err != nil {
+		return err
+	}
+	return s.bind(ctx, route, conn)
+}
+
 func (s *Server) handleHTTP(ctx context.Context, conn net.Conn) error {
+	raw := conn
+	err := setReadTimeout(conn, s.timeouts.HeaderRead)
+	if err != nil {
+		return err
+	}
+
+	conn, err = s.acceptProxyProtocol(conn)
+	if err != nil {
+		return err
+	}
+
+	if !s.allowedConn(nil, conn) {
+		resetConn(raw)
+		return errAccessDenied
+	}
+
+	release, ok := s.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		resetConn(raw)
+		return errConnLimit
+	}
+	defer release()
+
 	conn, host, err := connGetHTTPHost(conn)
 	if err != nil {
 		return err
@@ -152,7 +537,38 @@ func (s *Server) handleHTTP(ctx context.Context, conn net.Conn) error {
 		return fmt.Errorf("not route %q", host)
 	}
 
+	if !s.allowedConn(route, conn) {
+		resetConn(raw)
+		return errAccessDenied
+	}
+	defer s.metrics.trackConn("http", route.name())()
+
+	if route.clientAuth != nil && route.Stream {
+		resetConn(raw)
+		return errClientCertRequired
+	}
+
+	releaseRoute, ok := route.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		if route.Stream {
+			resetConn(raw)
+		} else {
+			connHTTPError(conn, http.StatusServiceUnavailable)
+		}
+		return errConnLimit
+	}
+	defer releaseRoute()
+
+	if route.Stream && !route.allowConn(addrIP(conn.RemoteAddr())) {
+		resetConn(raw)
+		return errRateLimit
+	}
+
 	if !route.HTTP.ForceTLS {
+		err = setReadTimeout(conn, 0)
+		if err != nil {
+			return err
+		}
 		return s.bind(ctx, route, conn)
 	}
 
@@ -171,6 +587,29 @@ func (s *Server) handleHTTP(ctx context.Context, conn net.Conn) error {
 }
 
 func (s *Server) handleTLS(ctx context.Context, conn net.Conn) error {
+	raw := conn
+	err := setReadTimeout(conn, s.timeouts.HeaderRead)
+	if err != nil {
+		return err
+	}
+
+	conn, err = s.acceptProxyProtocol(conn)
+	if err != nil {
+		return err
+	}
+
+	if !s.allowedConn(nil, conn) {
+		resetConn(raw)
+		return errAccessDenied
+	}
+
+	release, ok := s.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		resetConn(raw)
+		return errConnLimit
+	}
+	defer release()
+
 	conn, host, err := tlsHostWithConn(conn)
 	if err != nil {
 		return err
@@ -185,17 +624,59 @@ func (s *Server) handleTLS(ctx context.Context, conn net.Conn) error {
 		return fmt.Errorf("not route %q", host)
 	}
 
+	if !s.allowedConn(route, conn) {
+		resetConn(raw)
+		return errAccessDenied
+	}
+	defer s.metrics.trackConn("https", route.name())()
+
+	releaseRoute, ok := route.limits.acquire(addrIP(conn.RemoteAddr()))
+	if !ok {
+		resetConn(raw)
+		return errConnLimit
+	}
+	defer releaseRoute()
+
+	if route.Stream && !route.allowConn(addrIP(conn.RemoteAddr())) {
+		resetConn(raw)
+		return errRateLimit
+	}
+
+	err = setReadTimeout(conn, 0)
+	if err != nil {
+		return err
+	}
+
 	tlsConn := tls.Server(conn, s.tlsConfig)
-	err = tlsConn.HandshakeContext(ctx)
+	err = s.handshake(ctx, route, tlsConn)
 	if err != nil {
+		atomic.AddInt64(s.metrics.handshakeErrors.with(handshakeReason(err)), 1)
 		return err
 	}
 
+	if route.clientAuth != nil {
+		state := tlsConn.ConnectionState()
+		err = route.clientAuth.verified(&state)
+		if err != nil {
+			resetConn(raw)
+			return err
+		}
+	}
+
 	return s.bind(ctx, route, tlsConn)
 }
 
-func (s *Server) dialTarget(o string) (net.Conn, string, error) {
-	u, err := url.Parse(o)
+func (s *Server) handshake(ctx context.Context, route *routeEntry, tlsConn *tls.Conn) error {
+	if route.timeouts.Handshake > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, route.timeouts.Handshake)
+		defer cancel()
+	}
+	return tlsConn.HandshakeContext(ctx)
+}
+
+func (s *Server) dialTarget(route *routeEntry, downstream net.Conn) (net.Conn, string, error) {
+	u, err := url.Parse(route.Target)
 	if err != nil {
 		return nil, "", err
 	}
@@ -207,10 +688,15 @@ func (s *Server) dialTarget(o string) (net.Conn, string, error) {
 		}
 		host := u.Hostname()
 
-		conn, err := s.httpClient.Dial(net.JoinHostPort(host, port))
+		conn, err := route.dial(net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, "", err
 		}
+		err = sendProxyProtocol(conn, route.SendProxyProtocol, downstream)
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
 		return conn, host, nil
 	case "https":
 		port := u.Port()
@@ -218,36 +704,125 @@ func (s *Server) dialTarget(o string) (net.Conn, string, error) {
 			port = "443"
 		}
 		host := u.Hostname()
-		conn, err := s.httpClient.Dial(net.JoinHostPort(host, port))
+		conn, err := route.dial(net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, "", err
 		}
+		err = sendProxyProtocol(conn, route.SendProxyProtocol, downstream)
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
 
+		var serverName string
+		if stater, ok := downstream.(tlsConnectionStater); ok {
+			serverName = stater.ConnectionState().ServerName
+		}
 		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         upstreamSNI(route.Route, host, serverName),
 			InsecureSkipVerify: true,
 		})
 		if err != nil {
 			return nil, "", err
 		}
 		return tlsConn, host, nil
+	case "tcp":
+		host := u.Hostname()
+		conn, err := route.dial(u.Host)
+		if err != nil {
+			return nil, "", err
+		}
+		err = sendProxyProtocol(conn, route.SendProxyProtocol, downstream)
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		return conn, host, nil
+	case "unix", "http+unix":
+		conn, err := route.dial(u.Path)
+		if err != nil {
+			return nil, "", err
+		}
+		err = sendProxyProtocol(conn, route.SendProxyProtocol, downstream)
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		return conn, "", nil
 	}
 	return nil, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
 }
 
-func (s *Server) bind(ctx context.Context, route Route, downstream net.Conn) error {
+// upstreamSNI returns the server name for the TLS handshake with the upstream,
+// the preserved one is the Host of the request or the server name sent by the client of a stream.
+// The upstream host is the virtual host of the upstream, so it's sent as the server name
+// when it's not overridden.
+// No server name is sent for an IP address.
+func upstreamSNI(route Route, host, serverName string) string {
+	switch {
+	case route.UpstreamSNI != "":
+		return route.UpstreamSNI
+	case route.PreserveHost && serverName != "":
+		return serverName
+	case route.UpstreamHost != "":
+		host = route.UpstreamHost
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+func (s *Server) bind(ctx context.Context, route *routeEntry, downstream net.Conn) error {
+	downstream = throttleConn(ctx, downstream, s.bandwidth, route.bandwidth, newByteLimiter(route.ConnBandwidth))
 	if !route.Stream {
-		return s.httpServer.ServeConn(downstream)
+		return route.httpServer.ServeConn(downstream)
 	} else {
-		upstream, _, err := s.dialTarget(route.Target)
+		var entry *accessLogEntry
+		if s.accessLog != nil {
+			entry = s.newStreamLogEntry(route, downstream)
+		}
+		upstream, _, err := s.dialTarget(route, downstream)
 		if err != nil {
+			if entry != nil {
+				entry.Duration = time.Since(entry.Time).Seconds()
+				entry.CloseReason = closeReasonDialError
+				s.writeAccessLog(entry)
+			}
 			return err
 		}
 		defer upstream.Close()
-		return s.stream(ctx, route, upstream, downstream)
+		return s.stream(ctx, route, upstream, downstream, entry)
 	}
 }
 
 func (s *Server) handler(ctx *fasthttp.RequestCtx) {
+	start := time.Now()
+	// The host is taken before the request is rewritten for the upstream
+	name := "unknown"
+	route, ok := s.route[string(ctx.Host())]
+	if ok {
+		name = route.name()
+	}
+	var entry *accessLogEntry
+	if s.accessLog != nil {
+		entry = s.newRequestLogEntry(ctx, route)
+	}
+	defer func() {
+		duration := time.Since(start)
+		atomic.AddInt64(s.metrics.requests.with(name, strconv.Itoa(ctx.Response.StatusCode())), 1)
+		s.metrics.requestDuration.observe(duration, name)
+		if entry != nil {
+			entry.Route = name
+			entry.Status = ctx.Response.StatusCode()
+			entry.Bytes = int64(len(ctx.Response.Body()))
+			entry.Duration = duration.Seconds()
+			s.writeAccessLog(entry)
+		}
+	}()
 	err := s.handlerErr(ctx)
 	if err != nil {
 		if s.logger != nil {
@@ -266,19 +841,102 @@ func (s *Server) handlerErr(ctx *fasthttp.RequestCtx) error {
 		return fmt.Errorf("not route %q", host)
 	}
 
+	if route.clientAuth != nil {
+		// The client certificate is verified for the SNI only,
+		// the requests to the route over plain HTTP or another SNI are refused
+		state := ctx.TLSConnectionState()
+		if state == nil || !strings.EqualFold(state.ServerName, host) {
+			resp.SetStatusCode(fasthttp.StatusMisdirectedRequest)
+			resp.SetConnectionClose()
+			return nil
+		}
+		if route.clientAuth.verified(state) != nil {
+			resp.SetStatusCode(fasthttp.StatusForbidden)
+			resp.SetConnectionClose()
+			return nil
+		}
+	}
+
+	clientIP := s.clientIP(ctx)
+	if !s.access.allowed(clientIP) || !route.access.allowed(clientIP) {
+		resp.SetStatusCode(fasthttp.StatusForbidden)
+		resp.SetConnectionClose()
+		return nil
+	}
+
+	if ok, wait := route.allowRequest(clientIP, req); !ok {
+		resp.SetStatusCode(fasthttp.StatusTooManyRequests)
+		resp.Header.Set(fasthttp.HeaderRetryAfter, retryAfter(wait))
+		resp.SetConnectionClose()
+		return nil
+	}
+
+	origin := string(req.Header.Peek(fasthttp.HeaderOrigin))
+	if route.cors != nil && route.cors.isPreflight(req) {
+		route.cors.preflight(origin, req, resp)
+		resp.SetConnectionClose()
+		return nil
+	}
+
+	if route.auth != nil && !route.auth.exempt(req.URI().Path()) {
+		if !route.auth.check(req) {
+			route.auth.challenge(resp)
+			resp.SetConnectionClose()
+			return nil
+		}
+		if route.auth.conf.StripCredentials {
+			req.Header.Del(fasthttp.HeaderAuthorization)
+		}
+	}
+
+	if route.oidc != nil {
+		handled, err := route.oidc.handle(ctx, host)
+		if handled || err != nil {
+			resp.SetConnectionClose()
+			return err
+		}
+	}
+
+	if route.signedURL != nil {
+		if !route.signedURL.verify(req, time.Now()) {
+			resp.SetStatusCode(fasthttp.StatusForbidden)
+			resp.SetConnectionClose()
+			return nil
+		}
+		route.signedURL.strip(req)
+	}
+
 	u, err := url.Parse(route.Target)
 	if err != nil {
 		return err
 	}
 
-	req.URI().SetScheme(u.Scheme)
-	req.SetHost(u.Host)
-	req.SetConnectionClose()
+	// The key is taken before the request is rewritten for the upstream
+	cacheKey := requestCacheKey(req)
 
-	if route.HTTP.HeaderForwardedFor {
-		req.Header.Add(fasthttp.HeaderXForwardedFor, ctx.RemoteAddr().String())
+	s.forwardHeaders(ctx, route.HTTP, host)
+	if route.clientAuth != nil {
+		route.clientAuth.setHeaders(req, ctx.TLSConnectionState())
 	}
 
+	switch u.Scheme {
+	case "unix", "http+unix":
+		// The socket is dialed by the route, the host is only for the Host header
+		req.URI().SetScheme("http")
+		req.SetHost("localhost")
+	default:
+		req.URI().SetScheme(u.Scheme)
+		req.SetHost(u.Host)
+	}
+	if route.PreserveHost {
+		req.UseHostHeader = true
+		req.Header.SetHost(host)
+	} else if route.UpstreamHost != "" {
+		req.UseHostHeader = true
+		req.Header.SetHost(route.UpstreamHost)
+	}
+	req.SetConnectionClose()
+
 	if len(route.Replaces) != 0 {
 		length := req.Header.ContentLength()
 		if length != 0 &&
@@ -302,23 +960,54 @@ func (s *Server) handlerErr(ctx *fasthttp.RequestCtx) error {
 
 		referer := req.Header.Referer()
 		if len(referer) != 0 {
-			for _, replace := range route.Replaces {
-				referer = bytes.Replace(referer, []byte(replace.New), []byte(replace.Old), -1)
-			}
-			req.Header.SetRefererBytes(referer)
+			req.Header.SetRefererBytes(replaceBytes(referer, route.Replaces, true))
 		}
 
 		origin := req.Header.Peek(fasthttp.HeaderOrigin)
 		if len(origin) != 0 {
-			for _, replace := range route.Replaces {
-				origin = bytes.Replace(origin, []byte(replace.New), []byte(replace.Old), -1)
-			}
-			req.Header.SetBytesV(fasthttp.HeaderOrigin, origin)
+			req.Header.SetBytesV(fasthttp.HeaderOrigin, replaceBytes(origin, route.Replaces, true))
 		}
 	}
+	applyHeaderPolicy(&req.Header, route.RequestHeaders, route.Replaces, true)
 	req.SetConnectionClose()
 
-	err = s.httpClient.Do(req, resp)
+	if route.cache != nil {
+		err = route.cache.do(cacheKey, req, resp, func(req *fasthttp.Request, resp *fasthttp.Response) error {
+			return s.roundTrip(route, req, resp)
+		})
+	} else {
+		err = s.roundTrip(route, req, resp)
+	}
+	if err != nil {
+		// The upstream failed before anything was written to the client
+		resp.Reset()
+		if errors.Is(err, fasthttp.ErrTimeout) {
+			resp.SetStatusCode(fasthttp.StatusGatewayTimeout)
+		} else {
+			resp.SetStatusCode(fasthttp.StatusBadGateway)
+		}
+		resp.SetConnectionClose()
+		return err
+	}
+
+	// The headers are rewritten before the preset, so a rewritten header is kept
+	rewriteHeaders(&resp.Header, route.ResponseHeaders.Rewrite, route.Replaces, false)
+	if !route.HTTP.DisableDefaultHeaders {
+		applyDefaultResponseHeaders(req, resp, route.ResponseHeaders.Rewrite)
+	}
+	if route.cors != nil {
+		route.cors.response(origin, resp)
+	}
+	applyHeaderChanges(&resp.Header, route.ResponseHeaders)
+
+	resp.SetConnectionClose()
+
+	return nil
+}
+
+// roundTrip sends the request to the upstream and replaces the response.
+func (s *Server) roundTrip(route *routeEntry, req *fasthttp.Request, resp *fasthttp.Response) error {
+	err := route.httpClient.Do(req, resp)
 	if err != nil {
 		return err
 	}
@@ -346,80 +1035,80 @@ func (s *Server) handlerErr(ctx *fasthttp.RequestCtx) error {
 
 		timingAllowOrigin := resp.Header.Peek(fasthttp.HeaderTimingAllowOrigin)
 		if len(timingAllowOrigin) != 0 {
-			for _, replace := range route.Replaces {
-				timingAllowOrigin = bytes.Replace(timingAllowOrigin, []byte(replace.Old), []byte(replace.New), -1)
-			}
-			resp.Header.SetBytesV(fasthttp.HeaderTimingAllowOrigin, timingAllowOrigin)
+			resp.Header.SetBytesV(fasthttp.HeaderTimingAllowOrigin, replaceBytes(timingAllowOrigin, route.Replaces, false))
 		}
 
 		if code := resp.StatusCode(); code >= 300 && code < 400 {
 			location := resp.Header.Peek(fasthttp.HeaderLocation)
 			if len(location) != 0 {
-				for _, replace := range route.Replaces {
-					location = bytes.Replace(location, []byte(replace.Old), []byte(replace.New), -1)
-				}
-				resp.Header.SetBytesV(fasthttp.HeaderLocation, location)
+				resp.Header.SetBytesV(fasthttp.HeaderLocation, replaceBytes(location, route.Replaces, false))
 			}
 		}
 	}
-
-	if len(req.Header.Referer()) != 0 {
-		resp.Header.Set(fasthttp.HeaderAccessControlAllowOrigin, "*")
-	}
-
-	resp.Header.Del(fasthttp.HeaderAltSvc)
-	resp.Header.Del(fasthttp.HeaderContentSecurityPolicy)
-
-	resp.SetConnectionClose()
-
 	return nil
 }
 
-func (s *Server) stream(ctx context.Context, route Route, upstream, downstream net.Conn) error {
+// stream tunnels the connections, the entry is written to the access log once closed if it's not nil.
+func (s *Server) stream(ctx context.Context, route *routeEntry, upstream, downstream net.Conn, entry *accessLogEntry) error {
+	counting := &countingConn{
+		Conn:         downstream,
+		readTotal:    s.metrics.tunnelBytes.with(route.name(), "in"),
+		writtenTotal: s.metrics.tunnelBytes.with(route.name(), "out"),
+	}
+	downstream = counting
 	if len(route.Replaces) != 0 {
 		var reuse func()
-		downstream, upstream, reuse = s.replace(route, downstream, upstream)
+		downstream, upstream, reuse = s.replace(route.Route, downstream, upstream)
 		if reuse != nil {
 			defer reuse()
 		}
 	}
-	return s.tunnel(ctx, downstream, upstream)
+	err := s.tunnel(ctx, downstream, upstream, route.timeouts.Idle)
+	if entry != nil {
+		entry.Duration = time.Since(entry.Time).Seconds()
+		entry.BytesIn = atomic.LoadInt64(&counting.read)
+		entry.BytesOut = atomic.LoadInt64(&counting.written)
+		entry.CloseReason = closeReason(ctx, err)
+		s.writeAccessLog(entry)
+	}
+	return err
 }
 
 func (s *Server) replace(route Route, downstream, upstream net.Conn) (net.Conn, net.Conn, func()) {
 	if len(route.Replaces) == 0 {
 		return downstream, upstream, nil
 	}
-	bufs := make([]interface{}, 0, len(route.Replaces))
+	bufs := make([][]byte, 0, 2*len(route.Replaces))
 	for _, replace := range route.Replaces {
 		new := []byte(replace.New)
 		old := []byte(replace.Old)
-		buf1 := bytesPool.Get().([]byte)
-		buf2 := bytesPool.Get().([]byte)
+		buf1 := getBytes()
+		buf2 := getBytes()
 		downstream = connReplaceReader(downstream, new, old, buf1)
 		upstream = connReplaceReader(upstream, old, new, buf2)
 		bufs = append(bufs, buf1, buf2)
 	}
 	return downstream, upstream, func() {
 		for _, buf := range bufs {
-			bytesPool.Put(buf)
+			putBytes(buf)
 		}
 	}
 }
 
-func (s *Server) tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser) error {
-	buf1 := bytesPool.Get().([]byte)
-	buf2 := bytesPool.Get().([]byte)
+func (s *Server) tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, idleTimeout time.Duration) error {
+	buf1 := getBytes()
+	buf2 := getBytes()
 	defer func() {
-		bytesPool.Put(buf1)
-		bytesPool.Put(buf2)
+		putBytes(buf1)
+		putBytes(buf2)
 	}()
-	return tunnel(ctx, c1, c2, buf1, buf2)
+	return tunnel(ctx, c1, c2, buf1, buf2, idleTimeout)
 }
 
 // readerPool is a pool of bufio.Reader.
 var bytesPool = &sync.Pool{
 	New: func() interface{} {
+		atomic.AddInt64(&bytesPoolStats.allocs, 1)
 		return make([]byte, 32*1024)
 	},
 }
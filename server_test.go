@@ -0,0 +1,476 @@
+package easiest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getThrough sends a request for the host to the address and returns the body of the response.
+func getThrough(t *testing.T, addr, host string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	return string(body)
+}
+
+func Test_upstreamSNI(t *testing.T) {
+	tests := []struct {
+		name       string
+		route      Route
+		host       string
+		serverName string
+		want       string
+	}{
+		{
+			name: "host",
+			host: "upstream.test",
+			want: "upstream.test",
+		},
+		{
+			name: "ip",
+			host: "127.0.0.1",
+			want: "",
+		},
+		{
+			name:  "override",
+			route: Route{UpstreamSNI: "sni.test", UpstreamHost: "b.test", PreserveHost: true},
+			host:  "127.0.0.1",
+			want:  "sni.test",
+		},
+		{
+			name:       "preserve host",
+			route:      Route{PreserveHost: true},
+			host:       "127.0.0.1",
+			serverName: "a.test",
+			want:       "a.test",
+		},
+		{
+			name:  "preserve host without server name",
+			route: Route{PreserveHost: true},
+			host:  "upstream.test",
+			want:  "upstream.test",
+		},
+		{
+			name:  "upstream host",
+			route: Route{UpstreamHost: "b.test:8443"},
+			host:  "127.0.0.1",
+			want:  "b.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamSNI(tt.route, tt.host, tt.serverName); got != tt.want {
+				t.Errorf("upstreamSNI() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// tlsDownstream is a downstream connection with the TLS state of a client.
+type tlsDownstream struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *tlsDownstream) Handshake() error {
+	return nil
+}
+
+func (c *tlsDownstream) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func Test_Server_dialTarget_sni(t *testing.T) {
+	serverNames := make(chan string, 1)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "upstream.test")},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{
+			name: "ip",
+			want: "",
+		},
+		{
+			name:  "preserve host",
+			route: Route{PreserveHost: true},
+			want:  "a.test",
+		},
+		{
+			name:  "upstream host",
+			route: Route{UpstreamHost: "b.test"},
+			want:  "b.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.route.Domain = "a.test"
+			tt.route.Target = "https://" + listener.Addr().String()
+			tt.route.Stream = true
+			route, err := newRouteEntry(tt.route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err != nil {
+				t.Fatal(err)
+			}
+			downstream := &tlsDownstream{
+				state: tls.ConnectionState{ServerName: "a.test"},
+			}
+			upstream, _, err := (&Server{}).dialTarget(route, downstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer upstream.Close()
+			err = upstream.(*tls.Conn).Handshake()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-serverNames; got != tt.want {
+				t.Errorf("server name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Server_handlerErr_sni(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{
+			name:  "upstream sni",
+			route: Route{UpstreamSNI: "sni.test", UpstreamHost: "b.test"},
+			want:  "sni.test",
+		},
+		{
+			name:  "upstream host",
+			route: Route{UpstreamHost: "b.test:8443"},
+			want:  "b.test",
+		},
+		{
+			name:  "preserve host",
+			route: Route{PreserveHost: true},
+			want:  "a.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := newTestCertificate(t, tt.want)
+			serverNames := make(chan string, 1)
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			upstream.TLS = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					serverNames <- hello.ServerName
+					return nil, nil
+				},
+			}
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			tt.route.Domain = "a.test"
+			tt.route.Target = upstream.URL
+			s, err := NewServer(Config{Routes: []Route{tt.route}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The certificate of the upstream is verified for the server name
+			roots := x509.NewCertPool()
+			roots.AddCert(leaf)
+			s.route["a.test"].httpClient.TLSConfig.RootCAs = roots
+
+			addr := bindTestServer(t, s, "a.test")
+			getThrough(t, addr, "a.test")
+			if got := <-serverNames; got != tt.want {
+				t.Errorf("server name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Server_handlerErr_host(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+	tests := []struct {
+		name  string
+		route Route
+		want  string
+	}{
+		{
+			name: "target",
+			want: target,
+		},
+		{
+			name:  "upstream host",
+			route: Route{UpstreamHost: "b.test"},
+			want:  "b.test",
+		},
+		{
+			name:  "preserve host",
+			route: Route{PreserveHost: true},
+			want:  "a.test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.route.Domain = "a.test"
+			tt.route.Target = upstream.URL
+			addr := bindTestRoute(t, Config{Routes: []Route{tt.route}}, "a.test")
+			if got := getThrough(t, addr, "a.test"); got != tt.want {
+				t.Errorf("upstream Host = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Server_handlerErr_badGateway(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "http://" + closed.Addr().String()
+	closed.Close()
+	addr := bindTestRoute(t, Config{
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: target,
+			},
+		},
+	}, "a.test")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func Test_Server_startListen(t *testing.T) {
+	tests := []struct {
+		name         string
+		replaces     []Replace
+		wantUpstream string
+		wantClient   string
+	}{
+		{
+			name:         "plain",
+			wantUpstream: "GET mirror.com\n",
+			wantClient:   "from upstream.com",
+		},
+		{
+			name: "replaces",
+			replaces: []Replace{
+				{
+					Old: "upstream.com",
+					New: "mirror.com",
+				},
+			},
+			wantUpstream: "GET upstream.com\n",
+			wantClient:   "from mirror.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			upstream, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer upstream.Close()
+			go func() {
+				conn, err := upstream.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				received <- line
+				io.WriteString(conn, "from upstream.com")
+			}()
+
+			s, err := NewServer(Config{
+				Routes: []Route{
+					{
+						Listen:   "127.0.0.1:0",
+						Target:   "tcp://" + upstream.Addr().String(),
+						Replaces: tt.replaces,
+					},
+				},
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go s.startListen(ctx, s.listenRoutes[0], listener)
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = io.WriteString(conn, "GET mirror.com\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line := <-received; line != tt.wantUpstream {
+				t.Errorf("upstream received %q, want %q", line, tt.wantUpstream)
+			}
+			if string(got) != tt.wantClient {
+				t.Errorf("client received %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+}
+
+func Test_newRouteEntry_httpOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+	}{
+		{
+			name:  "request headers",
+			route: Route{RequestHeaders: HeaderPolicy{Set: map[string]string{"X-A": "a"}}},
+		},
+		{
+			name:  "response headers",
+			route: Route{ResponseHeaders: HeaderPolicy{Remove: []string{"Server"}}},
+		},
+		{
+			name:  "disable default headers",
+			route: Route{HTTP: HttpConfig{DisableDefaultHeaders: true}},
+		},
+		{
+			name:  "cors",
+			route: Route{CORS: &CORSConfig{AllowOrigins: []string{"https://b.test"}}},
+		},
+		{
+			name:  "forwarding headers",
+			route: Route{HTTP: HttpConfig{HeaderRealIP: true}},
+		},
+		{
+			name:  "auth",
+			route: Route{Auth: &AuthConfig{Tokens: []string{"token"}}},
+		},
+		{
+			name:  "oidc",
+			route: Route{OIDC: &OIDCConfig{Issuer: "https://issuer.test", ClientID: "client", CookieSecret: "0123456789abcdef"}},
+		},
+		{
+			name:  "signed url",
+			route: Route{SignedURL: &SignedURLConfig{Key: "key"}},
+		},
+		{
+			name:  "cache",
+			route: Route{Cache: &CacheConfig{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			route.Domain = "a.test"
+			route.Target = "http://127.0.0.1:8080"
+			_, err := newRouteEntry(route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err != nil {
+				t.Fatalf("http route: newRouteEntry() error = %v", err)
+			}
+
+			route.Stream = true
+			_, err = newRouteEntry(route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err == nil {
+				t.Error("stream route: newRouteEntry() = nil error, want the option rejected")
+			}
+
+			route = tt.route
+			route.Listen = "127.0.0.1:2222"
+			route.Target = "tcp://127.0.0.1:22"
+			_, err = newRouteEntry(route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err == nil {
+				t.Error("listen route: newRouteEntry() = nil error, want the option rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package easiest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// signedURL verifies the requests signed by SignURL.
+type signedURL struct {
+	conf SignedURLConfig
+}
+
+func newSignedURL(conf SignedURLConfig) (*signedURL, error) {
+	if conf.Key == "" {
+		return nil, fmt.Errorf("key is required")
+	}
+	if conf.Param == "" {
+		conf.Param = "signature"
+	}
+	if conf.ExpiresParam == "" {
+		conf.ExpiresParam = "expires"
+	}
+	if conf.Header == "" {
+		conf.Header = "X-Signature"
+	}
+	if conf.ExpiresHeader == "" {
+		conf.ExpiresHeader = "X-Signature-Expires"
+	}
+	return &signedURL{
+		conf: conf,
+	}, nil
+}
+
+// SignURL returns the URL with the signature valid until the expires.
+func SignURL(conf SignedURLConfig, rawURL string, expires time.Time) (string, error) {
+	s, err := newSignedURL(conf)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Del(s.conf.Param)
+	query.Del(s.conf.ExpiresParam)
+	exp := expires.Unix()
+	signature := s.signature(u.Path, query, exp)
+	query.Set(s.conf.ExpiresParam, strconv.FormatInt(exp, 10))
+	query.Set(s.conf.Param, signature)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// verify reports whether the request has a valid signature not expired,
+// the signature and the expiry are taken from the query or else the headers.
+func (s *signedURL) verify(req *fasthttp.Request, now time.Time) bool {
+	args := req.URI().QueryArgs()
+	signature := args.Peek(s.conf.Param)
+	if len(signature) == 0 {
+		signature = req.Header.Peek(s.conf.Header)
+	}
+	expires := args.Peek(s.conf.ExpiresParam)
+	if len(expires) == 0 {
+		expires = req.Header.Peek(s.conf.ExpiresHeader)
+	}
+	if len(signature) == 0 || len(expires) == 0 {
+		return false
+	}
+	exp, err := strconv.ParseInt(string(expires), 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return false
+	}
+
+	query := url.Values{}
+	args.VisitAll(func(key, value []byte) {
+		k := string(key)
+		if k == s.conf.Param || k == s.conf.ExpiresParam {
+			return
+		}
+		query.Add(k, string(value))
+	})
+	want := s.signature(string(req.URI().Path()), query, exp)
+	return hmac.Equal(signature, []byte(want))
+}
+
+// strip removes the signature and the expiry from the request.
+func (s *signedURL) strip(req *fasthttp.Request) {
+	args := req.URI().QueryArgs()
+	args.Del(s.conf.Param)
+	args.Del(s.conf.ExpiresParam)
+	// The query string is kept as is when no args are left, so it's set back
+	req.URI().SetQueryStringBytes(args.QueryString())
+	req.Header.Del(s.conf.Header)
+	req.Header.Del(s.conf.ExpiresHeader)
+}
+
+// signature is the HMAC-SHA256 of the path, the sorted query and the expiry.
+func (s *signedURL) signature(path string, query url.Values, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.conf.Key))
+	mac.Write([]byte(path))
+	mac.Write([]byte("?"))
+	mac.Write([]byte(query.Encode()))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,108 @@
+package easiest
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func Test_signedURL_verify(t *testing.T) {
+	conf := SignedURLConfig{Key: "key"}
+	now := time.Now()
+	signed, err := SignURL(conf, "https://example.com/files/a.tar.gz?arch=amd64", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := SignURL(conf, "https://example.com/files/a.tar.gz?arch=amd64", now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noQuery, err := SignURL(conf, "https://example.com/files/a.tar.gz", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	query := u.Query()
+
+	tests := []struct {
+		name    string
+		uri     string
+		headers map[string]string
+		want    bool
+	}{
+		{
+			name: "signed",
+			uri:  signed,
+			want: true,
+		},
+		{
+			name: "expired",
+			uri:  expired,
+			want: false,
+		},
+		{
+			name: "other path",
+			uri:  "https://example.com/files/b.tar.gz?" + u.RawQuery,
+			want: false,
+		},
+		{
+			name: "other query",
+			uri:  signed + "&arch=arm64",
+			want: false,
+		},
+		{
+			name: "other key",
+			uri:  "https://example.com/files/a.tar.gz?arch=amd64&expires=" + query.Get("expires") + "&signature=AAAA",
+			want: false,
+		},
+		{
+			name: "headers",
+			uri:  "https://example.com/files/a.tar.gz?arch=amd64",
+			headers: map[string]string{
+				"X-Signature":         query.Get("signature"),
+				"X-Signature-Expires": query.Get("expires"),
+			},
+			want: true,
+		},
+		{
+			name: "no other query",
+			uri:  noQuery,
+			want: true,
+		},
+		{
+			name: "unsigned",
+			uri:  "https://example.com/files/a.tar.gz?arch=amd64",
+			want: false,
+		},
+	}
+	s, err := newSignedURL(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			req.SetRequestURI(tt.uri)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			if got := s.verify(req, now); got != tt.want {
+				t.Errorf("verify() = %v, want %v", got, tt.want)
+			}
+			if !tt.want {
+				return
+			}
+			s.strip(req)
+			want := "/files/a.tar.gz"
+			if tt.uri != noQuery {
+				want += "?arch=amd64"
+			}
+			if got := string(req.RequestURI()); got != want {
+				t.Errorf("strip() = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -4,33 +4,28 @@ import (
 	"bytes"
 	"io"
 	"net"
-	"time"
 )
 
 func connReplaceReader(conn net.Conn, old, new []byte, buf []byte) net.Conn {
-	type Conn interface {
-		//Read(b []byte) (n int, err error)
-
-		Write(b []byte) (n int, err error)
-		Close() error
-
-		LocalAddr() net.Addr
-
-		RemoteAddr() net.Addr
-		SetDeadline(t time.Time) error
-
-		SetReadDeadline(t time.Time) error
-		SetWriteDeadline(t time.Time) error
-	}
-	return struct {
-		Conn
-		io.Reader
-	}{
+	return &replaceConn{
 		Conn:   conn,
 		Reader: newReplaceReader(conn, old, new, buf),
 	}
 }
 
+type replaceConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c *replaceConn) Read(p []byte) (n int, err error) {
+	return c.Reader.Read(p)
+}
+
+func (c *replaceConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func newReplaceReader(r io.Reader, old, new []byte, buf []byte) io.Reader {
 	if buf == nil {
 		buf = make([]byte, 0, 32*1024)
@@ -95,9 +90,17 @@ func (r *replaceReader) replace(off int) int {
 	if len(r.old) == len(r.new) {
 		copy(r.buf[i:], r.new)
 	} else {
-		copy(r.buf[i+len(r.new):cap(r.buf)], r.buf[i+len(r.old):])
+		// The length is set before the copies, so the new is not cut at the old end of the buffer
+		size := len(r.buf) - len(r.old) + len(r.new)
+		if size > cap(r.buf) {
+			buf := make([]byte, len(r.buf), size)
+			copy(buf, r.buf)
+			r.buf = buf
+		}
+		tail := r.buf[i+len(r.old):]
+		r.buf = r.buf[:size]
+		copy(r.buf[i+len(r.new):], tail)
 		copy(r.buf[i:], r.new)
-		r.buf = r.buf[:len(r.buf)-len(r.old)+len(r.new)]
 	}
 
 	return i + len(r.new) + 1
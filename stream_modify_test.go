@@ -45,6 +45,24 @@ func Test_newReplaceReader(t *testing.T) {
 			},
 			want: []byte("123ABCD789"),
 		},
+		{
+			name: "3 -> 6 near the end",
+			args: args{
+				r:   strings.NewReader("1234567"),
+				old: []byte("456"),
+				new: []byte("ABCDEF"),
+			},
+			want: []byte("123ABCDEF7"),
+		},
+		{
+			name: "3 -> 5 at the end",
+			args: args{
+				r:   strings.NewReader("123456"),
+				old: []byte("456"),
+				new: []byte("ABCDE"),
+			},
+			want: []byte("123ABCDE"),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
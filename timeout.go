@@ -0,0 +1,72 @@
+package easiest
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// merge returns t with the non-zero timeouts of o.
+func (t TimeoutConfig) merge(o TimeoutConfig) TimeoutConfig {
+	if o.HeaderRead > 0 {
+		t.HeaderRead = o.HeaderRead
+	}
+	if o.Handshake > 0 {
+		t.Handshake = o.Handshake
+	}
+	if o.Read > 0 {
+		t.Read = o.Read
+	}
+	if o.Write > 0 {
+		t.Write = o.Write
+	}
+	if o.Idle > 0 {
+		t.Idle = o.Idle
+	}
+	if o.Dial > 0 {
+		t.Dial = o.Dial
+	}
+	if o.Response > 0 {
+		t.Response = o.Response
+	}
+	return t
+}
+
+// setReadTimeout sets the read deadline of conn from now, a zero timeout clears the deadline.
+func setReadTimeout(conn net.Conn, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+	return conn.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// withDialTimeout returns the dialer that gives up after the timeout.
+func withDialTimeout(forward proxy.Dialer, timeout time.Duration) proxy.Dialer {
+	if timeout <= 0 {
+		return forward
+	}
+	return &timeoutDialer{
+		forward: forward,
+		timeout: timeout,
+	}
+}
+
+type timeoutDialer struct {
+	forward proxy.Dialer
+	timeout time.Duration
+}
+
+func (d *timeoutDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *timeoutDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.forward.Dial(network, addr)
+}
@@ -0,0 +1,215 @@
+package easiest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// bindTestRoute serves the connections of the listener by the route of the domain.
+func bindTestRoute(t *testing.T, conf Config, domain string) string {
+	s, err := NewServer(conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bindTestServer(t, s, domain)
+}
+
+// bindTestServer serves the connections of the listener by the route of the domain of the server.
+func bindTestServer(t *testing.T, s *Server, domain string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.bind(ctx, s.route[domain], conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func Test_routeTimeouts_slowClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts TimeoutConfig
+	}{
+		{
+			name:     "read",
+			timeouts: TimeoutConfig{Read: 100 * time.Millisecond},
+		},
+		{
+			name:     "header read",
+			timeouts: TimeoutConfig{HeaderRead: 100 * time.Millisecond},
+		},
+		{
+			name:     "header read with a longer read",
+			timeouts: TimeoutConfig{HeaderRead: 100 * time.Millisecond, Read: 10 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := bindTestRoute(t, Config{
+				Routes: []Route{
+					{
+						Domain:   "a.test",
+						Target:   "http://127.0.0.1:1",
+						Timeouts: tt.timeouts,
+					},
+				},
+			}, "a.test")
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// The header is never finished
+			_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCutOff(t, conn)
+		})
+	}
+}
+
+// checkCutOff checks the connection is closed by the server in time.
+func checkCutOff(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Fatal("the slow client is not cut off")
+		}
+		break
+	}
+}
+
+func Test_Server_handleHTTP_slowHeader(t *testing.T) {
+	s, err := NewServer(Config{
+		Timeouts: TimeoutConfig{
+			HeaderRead: 100 * time.Millisecond,
+		},
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: "http://127.0.0.1:1",
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.startHTTP(ctx, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The Host is sniffed, the rest of the header never comes
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCutOff(t, conn)
+}
+
+func Test_routeTimeouts_slowUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	addr := bindTestRoute(t, Config{
+		Routes: []Route{
+			{
+				Domain: "a.test",
+				Target: upstream.URL,
+				Timeouts: TimeoutConfig{
+					Response: 100 * time.Millisecond,
+				},
+			},
+		},
+	}, "a.test")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.test\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func Test_newRouteEntry_headerRead(t *testing.T) {
+	timeouts := TimeoutConfig{HeaderRead: time.Second}
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{
+			name:  "http",
+			route: Route{Domain: "a.test", Target: "http://127.0.0.1:8080", Timeouts: timeouts},
+		},
+		{
+			name:  "listen",
+			route: Route{Listen: ":2222", Target: "tcp://127.0.0.1:22", Timeouts: timeouts},
+		},
+		{
+			name:    "stream",
+			route:   Route{Domain: "a.test", Target: "tcp://127.0.0.1:22", Stream: true, Timeouts: timeouts},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouteEntry(tt.route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRouteEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,38 +2,142 @@ package easiest
 
 import (
 	"context"
+	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// tunnel create tunnels for two io.ReadWriteCloser
-func tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) error {
+// halfCloseIdleTimeout is the idle timeout after one side has closed its writing,
+// when the tunnel has no idle timeout of its own.
+const halfCloseIdleTimeout = 60 * time.Second
+
+var errCloseWriteUnsupported = errors.New("close write unsupported")
+
+// closeWrite shuts down the writing side of c.
+func closeWrite(c interface{}) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
+
+// tunnel create tunnels for two io.ReadWriteCloser,
+// when one side reaches EOF its peer is half-closed and the other direction keeps flowing.
+func tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte, idleTimeout time.Duration) error {
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var errs tunnelErr
+	var lastActive = time.Now().UnixNano()
+	var remaining int32 = 2
+	var halfClosed sync.Once
+	var wg sync.WaitGroup
+
+	if idleTimeout > 0 {
+		go watchIdle(ctx, cancel, &lastActive, idleTimeout)
+	}
+
+	done := func(dst io.ReadWriteCloser, err error) {
+		if err != nil {
+			if ctx.Err() == nil {
+				errs.Set(err)
+			}
+			cancel()
+			return
+		}
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			cancel()
+			return
+		}
+		if closeWrite(dst) != nil {
+			cancel()
+			return
+		}
+		if idleTimeout <= 0 {
+			halfClosed.Do(func() {
+				go watchIdle(ctx, cancel, &lastActive, halfCloseIdleTimeout)
+			})
+		}
+	}
+
+	wg.Add(2)
 	go func() {
-		_, errs[0] = io.CopyBuffer(c1, c2, buf1)
-		cancel()
+		defer wg.Done()
+		err := copyBuffer(c1, c2, buf1, &lastActive)
+		done(c1, err)
 	}()
 	go func() {
-		_, errs[1] = io.CopyBuffer(c2, c1, buf2)
-		cancel()
+		defer wg.Done()
+		err := copyBuffer(c2, c1, buf2, &lastActive)
+		done(c2, err)
 	}()
 	<-ctx.Done()
-	errs[2] = c1.Close()
-	errs[3] = c2.Close()
-	errs[4] = ctx.Err()
-	if errs[4] == context.Canceled {
-		errs[4] = nil
-	}
+	errs.Set(c1.Close())
+	errs.Set(c2.Close())
+	wg.Wait()
 	return errs.FirstError()
 }
 
-type tunnelErr [5]error
-
-func (t tunnelErr) FirstError() error {
-	for _, err := range t {
+// copyBuffer copies from src to dst until EOF, recording the time of the last activity.
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte, lastActive *int64) error {
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(lastActive, time.Now().UnixNano())
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
 		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
 			return err
 		}
 	}
-	return nil
+}
+
+// watchIdle cancels the tunnel when nothing is transferred for the timeout.
+func watchIdle(ctx context.Context, cancel context.CancelFunc, lastActive *int64, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(lastActive)))
+			if idle >= timeout {
+				cancel()
+				return
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
+
+type tunnelErr struct {
+	mut  sync.Mutex
+	errs []error
+}
+
+func (t *tunnelErr) Set(err error) {
+	if err == nil {
+		return
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.errs = append(t.errs, err)
+}
+
+func (t *tunnelErr) FirstError() error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if len(t.errs) == 0 {
+		return nil
+	}
+	return t.errs[0]
 }
@@ -0,0 +1,70 @@
+package easiest
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_tunnel_halfClose(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstreamListener.Close()
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(append([]byte("response to "), request...))
+	}()
+
+	downstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downstreamListener.Close()
+	go func() {
+		downstream, err := downstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", upstreamListener.Addr().String())
+		if err != nil {
+			downstream.Close()
+			return
+		}
+		buf1 := make([]byte, 1024)
+		buf2 := make([]byte, 1024)
+		tunnel(context.Background(), connReplaceReader(downstream, []byte("a"), []byte("a"), nil), upstream, buf1, buf2, 0)
+	}()
+
+	conn, err := net.Dial("tcp", downstreamListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "response to request"; string(got) != want {
+		t.Errorf("tunnel() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+package easiest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/proxy"
+)
+
+const defaultUDPIdleTimeout = 60 * time.Second
+
+// udpRoute is the state of a route forwarding udp.
+type udpRoute struct {
+	targets     []string
+	next        uint32
+	idleTimeout time.Duration
+}
+
+func newUDPRoute(r Route, idleTimeout time.Duration) (*udpRoute, error) {
+	if r.Listen == "" {
+		return nil, fmt.Errorf("scheme udp needs listen")
+	}
+	u := &udpRoute{
+		idleTimeout: idleTimeout,
+	}
+	if u.idleTimeout <= 0 {
+		u.idleTimeout = defaultUDPIdleTimeout
+	}
+	for _, target := range append([]string{r.Target}, r.Targets...) {
+		t, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if t.Scheme != "udp" {
+			return nil, fmt.Errorf("unsupported scheme %q, only udp", t.Scheme)
+		}
+		u.targets = append(u.targets, t.Host)
+	}
+	return u, nil
+}
+
+// newUDPDial returns the dial function of the udp upstreams,
+// so they're limited like the connections of the other routes.
+func newUDPDial(forward proxy.Dialer) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return forward.Dial("udp", addr)
+	}
+}
+
+// nextTarget returns the targets in round robin.
+func (u *udpRoute) nextTarget() string {
+	i := atomic.AddUint32(&u.next, 1) - 1
+	return u.targets[int(i)%len(u.targets)]
+}
+
+// udpSessionQueue is the packets of a client waiting for the upstream,
+// the packets beyond are dropped like on a full socket buffer.
+const udpSessionQueue = 64
+
+// udpSession is the upstream of a client.
+type udpSession struct {
+	target     string
+	packets    chan []byte
+	lastActive int64
+	release    func()
+}
+
+func (s *Server) startUDP(ctx context.Context, route *routeEntry, svc net.PacketConn) error {
+	var mut sync.Mutex
+	sessions := map[string]*udpSession{}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := svc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		packet := append([]byte(nil), buf[:n]...)
+
+		// The session is removed under the same lock before it stops reading,
+		// so a packet is never queued to a session that has finished
+		key := addr.String()
+		mut.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			release, ok := s.acquireUDPSession(route, addrIP(addr))
+			if !ok {
+				mut.Unlock()
+				continue
+			}
+			session = &udpSession{
+				target:     route.udp.nextTarget(),
+				packets:    make(chan []byte, udpSessionQueue),
+				lastActive: time.Now().UnixNano(),
+				release:    release,
+			}
+			sessions[key] = session
+
+			go func() {
+				err := s.serveUDPSession(ctx, route, svc, addr, session, func() {
+					mut.Lock()
+					delete(sessions, key)
+					mut.Unlock()
+				})
+				if err != nil {
+					if s.logger != nil && !isClosedConnError(err) {
+						s.logger.Println("udp session", err)
+					}
+				}
+			}()
+		}
+		select {
+		case session.packets <- packet:
+		default:
+		}
+		mut.Unlock()
+	}
+}
+
+// acquireUDPSession takes the limits of a new session from the ip,
+// the packets can't wait so nothing is queued.
+func (s *Server) acquireUDPSession(route *routeEntry, ip net.IP) (release func(), ok bool) {
+	if !s.allowedIP(route, ip) {
+		return nil, false
+	}
+	releaseServer, ok := s.limits.tryAcquire(ip)
+	if !ok {
+		return nil, false
+	}
+	releaseRoute, ok := route.limits.tryAcquire(ip)
+	if !ok {
+		releaseServer()
+		return nil, false
+	}
+	if !route.allowConn(ip) {
+		releaseRoute()
+		releaseServer()
+		return nil, false
+	}
+	return func() {
+		releaseRoute()
+		releaseServer()
+	}, true
+}
+
+// serveUDPSession dials the upstream and forwards the packets of the client until the session is idle,
+// remove is called before the packets of the session are no longer read.
+func (s *Server) serveUDPSession(ctx context.Context, route *routeEntry, svc net.PacketConn, addr net.Addr, session *udpSession, remove func()) error {
+	defer session.release()
+
+	upstream, err := route.dial(session.target)
+	if err != nil {
+		remove()
+		return err
+	}
+	defer upstream.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.udpReturn(route.udp, svc, addr, upstream, session)
+	}()
+	for {
+		select {
+		case packet := <-session.packets:
+			atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+			_, err := upstream.Write(packet)
+			if err != nil {
+				if s.logger != nil {
+					s.logger.Println("write udp", err)
+				}
+			}
+		case err := <-done:
+			remove()
+			return err
+		case <-ctx.Done():
+			remove()
+			return nil
+		}
+	}
+}
+
+// udpReturn copies the packets from the upstream back to the client until the session is idle.
+func (s *Server) udpReturn(route *udpRoute, svc net.PacketConn, addr net.Addr, upstream net.Conn, session *udpSession) error {
+	buf := make([]byte, 64*1024)
+	for {
+		lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+		err := upstream.SetReadDeadline(lastActive.Add(route.idleTimeout))
+		if err != nil {
+			return err
+		}
+		n, err := upstream.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+				if time.Since(lastActive) < route.idleTimeout {
+					continue
+				}
+				return nil
+			}
+			return err
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		_, err = svc.WriteTo(buf[:n], addr)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package easiest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// startUDPEcho starts an upstream answering the packets with the prefix.
+func startUDPEcho(t *testing.T, prefix string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(prefix), buf[:n]...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startTestUDP starts the udp route and returns its address.
+func startTestUDP(t *testing.T, s *Server, r Route, forward proxy.Dialer) string {
+	svc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Listen = svc.LocalAddr().String()
+	if s.limits == nil {
+		s.limits = newConnLimits(LimitConfig{})
+	}
+	route, err := newRouteEntry(r, forward, TimeoutConfig{}, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		svc.Close()
+	})
+	go s.startUDP(ctx, route, svc)
+	return svc.LocalAddr().String()
+}
+
+// udpExchange sends the packet and returns the answer, or an empty string on timeout.
+func udpExchange(t *testing.T, conn net.Conn, packet string) string {
+	_, err := conn.Write([]byte(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func Test_startUDP_access(t *testing.T) {
+	upstream := startUDPEcho(t, "")
+	tests := []struct {
+		name   string
+		global AccessConfig
+		route  AccessConfig
+		want   string
+	}{
+		{
+			name: "allowed",
+			want: "ping",
+		},
+		{
+			name:   "global deny",
+			global: AccessConfig{Deny: []string{"127.0.0.1"}},
+		},
+		{
+			name:  "route allow others",
+			route: AccessConfig{Allow: []string{"10.0.0.0/8"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global, err := newAccess(tt.global)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{access: global}
+			addr := startTestUDP(t, s, Route{
+				Target: "udp://" + upstream,
+				Access: tt.route,
+			}, &net.Dialer{})
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := udpExchange(t, conn, "ping"); got != tt.want {
+				t.Errorf("answer = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_startUDP_limits(t *testing.T) {
+	upstream := startUDPEcho(t, "")
+	tests := []struct {
+		name   string
+		global LimitConfig
+		route  Route
+	}{
+		{
+			name:   "global",
+			global: LimitConfig{MaxConns: 1},
+		},
+		{
+			name:  "route",
+			route: Route{Limits: LimitConfig{MaxConns: 1}},
+		},
+		{
+			name:  "per ip",
+			route: Route{Limits: LimitConfig{MaxConnsPerIP: 1}},
+		},
+		{
+			name: "rate",
+			route: Route{
+				RateLimits: []RateLimitConfig{
+					{Key: "ip", Rate: 0.001, Burst: 1},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{limits: newConnLimits(tt.global)}
+			tt.route.Target = "udp://" + upstream
+			addr := startTestUDP(t, s, tt.route, &net.Dialer{})
+
+			first, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			if got := udpExchange(t, first, "ping"); got != "ping" {
+				t.Fatalf("first answer = %q, want %q", got, "ping")
+			}
+
+			// A new client gets no session over the limits
+			second, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Close()
+			if got := udpExchange(t, second, "ping"); got != "" {
+				t.Errorf("second answer = %q, want none", got)
+			}
+		})
+	}
+}
+
+func Test_startUDP_targets(t *testing.T) {
+	addr := startTestUDP(t, &Server{}, Route{
+		Target:  "udp://" + startUDPEcho(t, "a:"),
+		Targets: []string{"udp://" + startUDPEcho(t, "b:")},
+	}, &net.Dialer{})
+
+	got := map[string]bool{}
+	for i := 0; i != 2; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		first := udpExchange(t, conn, "ping")
+		got[first] = true
+		// The session keeps the upstream of the client
+		if second := udpExchange(t, conn, "ping"); second != first {
+			t.Errorf("second answer = %q, want %q", second, first)
+		}
+	}
+	if !got["a:ping"] || !got["b:ping"] {
+		t.Errorf("answers = %v, want both targets", got)
+	}
+}
+
+// blockingDialer blocks the dials of the address until it's released.
+type blockingDialer struct {
+	addr    string
+	release chan struct{}
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	if addr == d.addr {
+		<-d.release
+	}
+	return net.Dial(network, addr)
+}
+
+func Test_startUDP_slowDial(t *testing.T) {
+	slow := startUDPEcho(t, "slow:")
+	dialer := &blockingDialer{
+		addr:    slow,
+		release: make(chan struct{}),
+	}
+	addr := startTestUDP(t, &Server{}, Route{
+		Target:  "udp://" + slow,
+		Targets: []string{"udp://" + startUDPEcho(t, "fast:")},
+	}, dialer)
+
+	slowConn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slowConn.Close()
+	_, err = slowConn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fastConn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fastConn.Close()
+	if got := udpExchange(t, fastConn, "ping"); got != "fast:ping" {
+		t.Errorf("answer = %q, want %q while the other dial is blocked", got, "fast:ping")
+	}
+
+	// The packet is queued until the upstream is dialed
+	close(dialer.release)
+	slowConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := slowConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "slow:ping" {
+		t.Errorf("answer = %q, want %q", got, "slow:ping")
+	}
+}
+
+func Test_newRouteEntry_targets(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   Route
+		wantErr bool
+	}{
+		{
+			name: "udp",
+			route: Route{
+				Listen:  "127.0.0.1:0",
+				Target:  "udp://127.0.0.1:53",
+				Targets: []string{"udp://127.0.0.2:53"},
+			},
+		},
+		{
+			name: "udp without listen",
+			route: Route{
+				Target: "udp://127.0.0.1:53",
+			},
+			wantErr: true,
+		},
+		{
+			name: "mixed schemes",
+			route: Route{
+				Listen:  "127.0.0.1:0",
+				Target:  "udp://127.0.0.1:53",
+				Targets: []string{"tcp://127.0.0.2:53"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "http",
+			route: Route{
+				Domain:  "a.test",
+				Target:  "http://127.0.0.1:8080",
+				Targets: []string{"http://127.0.0.2:8080"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRouteEntry(tt.route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRouteEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_newRouteEntry_tcpOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+	}{
+		{
+			name:  "proxy",
+			route: Route{Proxy: "socks5://127.0.0.1:1080"},
+		},
+		{
+			name:  "no proxy",
+			route: Route{NoProxy: []string{"127.0.0.1"}},
+		},
+		{
+			name:  "replaces",
+			route: Route{Replaces: []Replace{{Old: "a", New: "b"}}},
+		},
+		{
+			name:  "bandwidth",
+			route: Route{Bandwidth: BandwidthConfig{Rate: 1024}},
+		},
+		{
+			name:  "conn bandwidth",
+			route: Route{ConnBandwidth: BandwidthConfig{Rate: 1024}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			route.Listen = "127.0.0.1:0"
+			route.Target = "tcp://127.0.0.1:22"
+			_, err := newRouteEntry(route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err != nil {
+				t.Fatalf("tcp route: newRouteEntry() error = %v", err)
+			}
+
+			route.Target = "udp://127.0.0.1:53"
+			_, err = newRouteEntry(route, &net.Dialer{}, TimeoutConfig{}, newMetrics())
+			if err == nil {
+				t.Error("udp route: newRouteEntry() = nil error, want the option rejected")
+			}
+		})
+	}
+}
@@ -51,6 +51,10 @@ func (c *unreadConn) Read(p []byte) (n int, err error) {
 	return c.Reader.Read(p)
 }
 
+func (c *unreadConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func wrapUnread(reader io.Reader, prefix []byte) io.Reader {
 	if len(prefix) == 0 {
 		return reader